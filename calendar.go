@@ -0,0 +1,579 @@
+// mautrix-groupme - A Matrix-GroupMe puppeting bridge.
+// Copyright (C) 2022 Sumner Evans, Karmanyaah Malhotra
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"maunium.net/go/mautrix/appservice"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/beeper/groupme-lib"
+
+	"github.com/beeper/groupme/database"
+	"github.com/beeper/groupme/groupmeext"
+)
+
+const groupMeEventAttachment = "event"
+
+// RSVPs to calendar events are bridged as reactions to the event message.
+const (
+	calendarGoingEmoji    = "✅"
+	calendarNotGoingEmoji = "❌"
+)
+
+func hasCalendarEventAttachment(message *groupme.Message) bool {
+	for _, attachment := range message.Attachments {
+		if attachment.Type == groupMeEventAttachment {
+			return true
+		}
+	}
+	return false
+}
+
+// handleGroupMeCalendarEvent bridges the calendar event attached to a GroupMe
+// message. Like with polls, the event ID is only available by refetching the
+// message.
+func (portal *Portal) handleGroupMeCalendarEvent(source *User, message *groupme.Message) (id.EventID, error) {
+	if portal.IsPrivateChat() {
+		return "", fmt.Errorf("calendar events are not supported in private chats")
+	}
+	details, err := source.Client.GetMessageDetails(context.TODO(), portal.Key.GMID, message.ID)
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch message details: %w", err)
+	}
+	attachment := details.GetAttachment(groupMeEventAttachment)
+	if attachment == nil || len(attachment.EventID) == 0 {
+		return "", fmt.Errorf("message has no calendar event ID")
+	}
+	dbEvent, err := portal.startCalendarEvent(source, attachment.EventID, message.CreatedAt.ToTime())
+	if err != nil {
+		return "", err
+	}
+	return dbEvent.MXID, nil
+}
+
+// startCalendarEvent sends the Matrix message of a GroupMe calendar event,
+// unless the event has been bridged already. The message is always sent by
+// the creator of the event, so that they can edit it later.
+func (portal *Portal) startCalendarEvent(source *User, eventID string, ts time.Time) (*database.CalendarEvent, error) {
+	if dbEvent := portal.bridge.DB.Calendar.GetByEventID(portal.Key, eventID); dbEvent != nil {
+		return dbEvent, nil
+	}
+	evt, err := source.Client.GetCalendarEvent(context.TODO(), portal.Key.GMID, eventID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch calendar event %s: %w", eventID, err)
+	}
+	intent := portal.getReactionIntent(evt.CreatorID)
+	content := renderCalendarEvent(evt)
+	resp, err := portal.sendMessage(intent, event.EventMessage, content, nil, ts.UnixMilli())
+	if err != nil {
+		return nil, fmt.Errorf("failed to send calendar event message: %w", err)
+	}
+	dbEvent := portal.bridge.DB.Calendar.New()
+	dbEvent.Chat = portal.Key
+	dbEvent.EventID = eventID
+	dbEvent.MXID = resp.EventID
+	dbEvent.Body = content.FormattedBody
+	dbEvent.ICS = calendarEventToICS(evt)
+	dbEvent.ICSMXID, err = portal.sendCalendarICS(intent, evt, dbEvent.ICS)
+	if err != nil {
+		portal.log.Warnfln("Failed to send calendar file of event %s: %v", eventID, err)
+	}
+	dbEvent.Insert()
+	portal.syncCalendarRSVPs(dbEvent, evt)
+	return dbEvent, nil
+}
+
+// resyncCalendarEvent updates the Matrix message of a GroupMe calendar event
+// after it was modified, cancelled or RSVPed to. Events that haven't been
+// bridged yet are skipped, they're bridged from their GroupMe message instead.
+func (portal *Portal) resyncCalendarEvent(source *User, eventID string) {
+	if len(portal.MXID) == 0 || !source.IsLoggedIn() || portal.IsPrivateChat() {
+		return
+	}
+	dbEvent := portal.bridge.DB.Calendar.GetByEventID(portal.Key, eventID)
+	if dbEvent == nil {
+		portal.log.Debugfln("Not resyncing calendar event %s: its message hasn't been bridged yet", eventID)
+		return
+	}
+	evt, err := source.Client.GetCalendarEvent(context.TODO(), portal.Key.GMID, eventID)
+	if err != nil {
+		portal.log.Warnfln("Failed to fetch calendar event %s: %v", eventID, err)
+		return
+	}
+	intent := portal.getReactionIntent(evt.CreatorID)
+	changed := false
+	if content := renderCalendarEvent(evt); content.FormattedBody != dbEvent.Body {
+		content.SetEdit(dbEvent.MXID)
+		_, err = portal.sendMessage(intent, event.EventMessage, content, nil, 0)
+		if err != nil {
+			portal.log.Errorfln("Failed to edit message of calendar event %s: %v", eventID, err)
+		} else {
+			dbEvent.Body = content.NewContent.FormattedBody
+			changed = true
+		}
+	}
+	if ics := calendarEventToICS(evt); ics != dbEvent.ICS {
+		// Files can't be edited, so the outdated file is replaced instead.
+		if len(dbEvent.ICSMXID) > 0 {
+			portal.redactWithFallback(intent, dbEvent.ICSMXID)
+		}
+		dbEvent.ICSMXID, err = portal.sendCalendarICS(intent, evt, ics)
+		if err != nil {
+			portal.log.Warnfln("Failed to send calendar file of event %s: %v", eventID, err)
+		}
+		dbEvent.ICS = ics
+		changed = true
+	}
+	if changed {
+		dbEvent.Update()
+	}
+	portal.syncCalendarRSVPs(dbEvent, evt)
+}
+
+// queueCalendarEventResync makes the portal message loop resync a calendar
+// event, so that it's handled in order with the messages of the portal.
+func (portal *Portal) queueCalendarEventResync(source *User, eventID string) {
+	if len(portal.MXID) == 0 {
+		return
+	}
+	portal.messages <- PortalMessage{
+		chat:            portal.Key,
+		source:          source,
+		data:            &groupme.Message{},
+		calendarEventID: eventID,
+	}
+}
+
+// syncCalendarRSVPs diffs the RSVPs to a GroupMe calendar event against the
+// bridged ones and updates the reactions of users whose answer changed.
+func (portal *Portal) syncCalendarRSVPs(dbEvent *database.CalendarEvent, evt *groupmeext.CalendarEvent) {
+	rsvps := make(map[groupme.ID]bool, len(evt.Going)+len(evt.NotGoing))
+	for _, userID := range evt.Going {
+		rsvps[userID] = true
+	}
+	for _, userID := range evt.NotGoing {
+		rsvps[userID] = false
+	}
+	for userID, bridged := range dbEvent.GetRSVPs() {
+		going, ok := rsvps[userID]
+		if ok && going == bridged.Going {
+			delete(rsvps, userID)
+			continue
+		}
+		if !portal.redactWithFallback(portal.getReactionIntent(userID), bridged.MXID) {
+			continue
+		}
+		dbEvent.DeleteRSVP(userID)
+	}
+	for userID, going := range rsvps {
+		emoji := calendarNotGoingEmoji
+		if going {
+			emoji = calendarGoingEmoji
+		}
+		resp, err := portal.sendReaction(portal.getReactionIntent(userID), dbEvent.MXID, emoji)
+		if err != nil {
+			portal.log.Errorfln("Failed to bridge RSVP of %s to calendar event %s: %v", userID, dbEvent.EventID, err)
+			continue
+		}
+		dbEvent.UpsertRSVP(&database.CalendarRSVP{User: userID, Going: going, MXID: resp.EventID})
+	}
+}
+
+// redactWithFallback redacts an event with the given intent, or with the main
+// intent if that fails.
+func (portal *Portal) redactWithFallback(intent *appservice.IntentAPI, evtID id.EventID) bool {
+	_, err := intent.RedactEvent(portal.MXID, evtID)
+	if err != nil && intent != portal.MainIntent() {
+		portal.log.Warnfln("Failed to redact %s, trying with main intent: %v", evtID, err)
+		_, err = portal.MainIntent().RedactEvent(portal.MXID, evtID)
+	}
+	if err != nil {
+		portal.log.Errorfln("Failed to redact %s: %v", evtID, err)
+		return false
+	}
+	return true
+}
+
+func (portal *Portal) sendCalendarICS(intent *appservice.IntentAPI, evt *groupmeext.CalendarEvent, ics string) (id.EventID, error) {
+	data, uploadMimeType, file := portal.encryptFile([]byte(ics), "text/calendar")
+	uploaded, err := intent.UploadBytes(data, uploadMimeType)
+	if err != nil {
+		return "", fmt.Errorf("failed to upload calendar file: %w", err)
+	}
+	content := &event.MessageEventContent{
+		MsgType: event.MsgFile,
+		Body:    "event.ics",
+		File:    file,
+		Info: &event.FileInfo{
+			Size:     len(ics),
+			MimeType: "text/calendar",
+		},
+	}
+	if content.File != nil {
+		content.File.URL = uploaded.ContentURI.CUString()
+	} else {
+		content.URL = uploaded.ContentURI.CUString()
+	}
+	resp, err := portal.sendMessage(intent, event.EventMessage, content, nil, 0)
+	if err != nil {
+		return "", err
+	}
+	return resp.EventID, nil
+}
+
+// renderCalendarEvent formats a GroupMe calendar event as a Matrix message.
+func renderCalendarEvent(evt *groupmeext.CalendarEvent) *event.MessageEventContent {
+	var body, formatted []string
+	title := "\U0001f4c5 " + evt.Name
+	htmlTitle := "\U0001f4c5 " + html.EscapeString(evt.Name)
+	if evt.IsCanceled() {
+		title += " (cancelled)"
+		htmlTitle = fmt.Sprintf("<del>%s</del> (cancelled)", htmlTitle)
+	}
+	body = append(body, title)
+	formatted = append(formatted, "<strong>"+htmlTitle+"</strong>")
+
+	when := "When: " + formatCalendarEventTime(evt)
+	body = append(body, when)
+	formatted = append(formatted, html.EscapeString(when))
+	if evt.Location != nil && len(evt.Location.Name) > 0 {
+		where := "Where: " + evt.Location.Name
+		if len(evt.Location.Address) > 0 && evt.Location.Address != evt.Location.Name {
+			where += ", " + evt.Location.Address
+		}
+		body = append(body, where)
+		formatted = append(formatted, html.EscapeString(where))
+	}
+	if description := strings.TrimSpace(evt.Description); len(description) > 0 {
+		body = append(body, "", description)
+		formatted = append(formatted, "", strings.ReplaceAll(html.EscapeString(description), "\n", "<br/>"))
+	}
+	counts := fmt.Sprintf("%s %d going · %s %d not going", calendarGoingEmoji, len(evt.Going), calendarNotGoingEmoji, len(evt.NotGoing))
+	body = append(body, "", counts)
+	formatted = append(formatted, "", counts)
+
+	return &event.MessageEventContent{
+		MsgType:       event.MsgText,
+		Body:          strings.Join(body, "\n"),
+		Format:        event.FormatHTML,
+		FormattedBody: strings.Join(formatted, "<br/>"),
+	}
+}
+
+func isSameDay(a, b time.Time) bool {
+	return a.Year() == b.Year() && a.YearDay() == b.YearDay()
+}
+
+// formatCalendarEventTime formats the start and end time of an event in the
+// timezone of the event.
+func formatCalendarEventTime(evt *groupmeext.CalendarEvent) string {
+	loc := evt.GetLocation()
+	start, end := evt.StartAt.In(loc), evt.EndAt.In(loc)
+	if evt.IsAllDay {
+		const dayFormat = "Monday, January 2, 2006"
+		// The end of all-day events is midnight of the day after.
+		if end.After(start) && end.Hour() == 0 && end.Minute() == 0 {
+			end = end.AddDate(0, 0, -1)
+		}
+		if !end.After(start) || isSameDay(start, end) {
+			return start.Format(dayFormat)
+		}
+		return start.Format(dayFormat) + " – " + end.Format(dayFormat)
+	}
+	const format = "Mon, Jan 2, 2006 3:04 PM"
+	if !end.After(start) {
+		return start.Format(format + " MST")
+	} else if isSameDay(start, end) {
+		return start.Format(format) + " – " + end.Format("3:04 PM MST")
+	}
+	return start.Format(format) + " – " + end.Format(format+" MST")
+}
+
+var icsEscaper = strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`)
+
+// writeICSLine writes a content line, folding it to 75 octets as required by
+// RFC 5545.
+func writeICSLine(buf *strings.Builder, line string) {
+	maxLength := 75
+	for len(line) > maxLength {
+		cut := maxLength
+		for cut > 0 && !utf8.RuneStart(line[cut]) {
+			cut--
+		}
+		buf.WriteString(line[:cut])
+		buf.WriteString("\r\n ")
+		line = line[cut:]
+		// The leading space of continuation lines counts towards the limit.
+		maxLength = 74
+	}
+	buf.WriteString(line)
+	buf.WriteString("\r\n")
+}
+
+// calendarEventToICS converts a GroupMe calendar event to an iCalendar file.
+func calendarEventToICS(evt *groupmeext.CalendarEvent) string {
+	const utcFormat = "20060102T150405Z"
+	const dateFormat = "20060102"
+	var buf strings.Builder
+	lines := []string{
+		"BEGIN:VCALENDAR",
+		"VERSION:2.0",
+		"PRODID:-//mautrix-groupme//EN",
+		"BEGIN:VEVENT",
+		"UID:" + evt.EventID + "@groupme.com",
+		"DTSTAMP:" + evt.CreatedAt.UTC().Format(utcFormat),
+	}
+	if evt.IsAllDay {
+		loc := evt.GetLocation()
+		start, end := evt.StartAt.In(loc), evt.EndAt.In(loc)
+		if !end.After(start) {
+			end = start.AddDate(0, 0, 1)
+		}
+		lines = append(lines, "DTSTART;VALUE=DATE:"+start.Format(dateFormat), "DTEND;VALUE=DATE:"+end.Format(dateFormat))
+	} else {
+		lines = append(lines, "DTSTART:"+evt.StartAt.UTC().Format(utcFormat))
+		if evt.EndAt.After(evt.StartAt) {
+			lines = append(lines, "DTEND:"+evt.EndAt.UTC().Format(utcFormat))
+		}
+	}
+	lines = append(lines, "SUMMARY:"+icsEscaper.Replace(evt.Name))
+	if evt.Location != nil && len(evt.Location.Name) > 0 {
+		location := evt.Location.Name
+		if len(evt.Location.Address) > 0 && evt.Location.Address != evt.Location.Name {
+			location += ", " + evt.Location.Address
+		}
+		lines = append(lines, "LOCATION:"+icsEscaper.Replace(location))
+		if len(evt.Location.Lat) > 0 && len(evt.Location.Lng) > 0 {
+			lines = append(lines, fmt.Sprintf("GEO:%s;%s", evt.Location.Lat, evt.Location.Lng))
+		}
+	}
+	if len(evt.Description) > 0 {
+		lines = append(lines, "DESCRIPTION:"+icsEscaper.Replace(evt.Description))
+	}
+	if evt.IsCanceled() {
+		lines = append(lines, "STATUS:CANCELLED")
+	} else {
+		lines = append(lines, "STATUS:CONFIRMED")
+	}
+	lines = append(lines, "END:VEVENT", "END:VCALENDAR")
+	for _, line := range lines {
+		writeICSLine(&buf, line)
+	}
+	return buf.String()
+}
+
+var weekdays = map[string]time.Weekday{
+	"sunday": time.Sunday, "sun": time.Sunday,
+	"monday": time.Monday, "mon": time.Monday,
+	"tuesday": time.Tuesday, "tue": time.Tuesday, "tues": time.Tuesday,
+	"wednesday": time.Wednesday, "wed": time.Wednesday,
+	"thursday": time.Thursday, "thu": time.Thursday, "thurs": time.Thursday,
+	"friday": time.Friday, "fri": time.Friday,
+	"saturday": time.Saturday, "sat": time.Saturday,
+}
+
+var relativeUnits = map[string]time.Duration{
+	"minute": time.Minute, "minutes": time.Minute, "min": time.Minute, "mins": time.Minute,
+	"hour": time.Hour, "hours": time.Hour, "hr": time.Hour, "hrs": time.Hour,
+	"day": 24 * time.Hour, "days": 24 * time.Hour,
+	"week": 7 * 24 * time.Hour, "weeks": 7 * 24 * time.Hour,
+}
+
+// parseEventTime parses the start time of a calendar event, like "tomorrow
+// 7pm", "friday at 18:30", "jan 5", "2023-01-05 9am" or "in 2 hours". If no
+// time of day is given, the event is an all-day event.
+func parseEventTime(input string, now time.Time) (start time.Time, allDay bool, err error) {
+	words := strings.Fields(strings.ToLower(input))
+	if len(words) == 0 {
+		return time.Time{}, false, fmt.Errorf("no time given")
+	} else if words[0] == "now" && len(words) == 1 {
+		return now, false, nil
+	} else if words[0] == "in" {
+		start, err = parseRelativeTime(words[1:], now)
+		return start, false, err
+	}
+
+	var date time.Time
+	hasDate, hasClock := false, false
+	var hour, minute int
+	for i := 0; i < len(words); i++ {
+		word := words[i]
+		weekday, isWeekday := weekdays[word]
+		switch {
+		case word == "at" || word == "on" || word == "next":
+			continue
+		case word == "today":
+			date, hasDate = now, true
+		case word == "tomorrow":
+			date, hasDate = now.AddDate(0, 0, 1), true
+		case isWeekday:
+			// Weekdays always refer to the next one after today.
+			days := (int(weekday) - int(now.Weekday()) + 6) % 7
+			date, hasDate = now.AddDate(0, 0, days+1), true
+		default:
+			// The am/pm suffix may be a separate word.
+			if i+1 < len(words) && (words[i+1] == "am" || words[i+1] == "pm") {
+				if h, m, ok := parseClock(word + words[i+1]); ok {
+					hour, minute, hasClock = h, m, true
+					i++
+					continue
+				}
+			}
+			if h, m, ok := parseClock(word); ok {
+				hour, minute, hasClock = h, m, true
+			} else if d, ok := parseDate(word, now); ok {
+				date, hasDate = d, true
+			} else if i+1 < len(words) {
+				// Month names are followed by the day as a separate word.
+				if d, ok := parseDate(word+" "+words[i+1], now); ok {
+					date, hasDate = d, true
+					i++
+					continue
+				}
+				return time.Time{}, false, fmt.Errorf("unrecognized time %q", words[i])
+			} else {
+				return time.Time{}, false, fmt.Errorf("unrecognized time %q", words[i])
+			}
+		}
+	}
+
+	if !hasDate {
+		date = now
+	}
+	if !hasClock {
+		return time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, now.Location()), true, nil
+	}
+	start = time.Date(date.Year(), date.Month(), date.Day(), hour, minute, 0, 0, now.Location())
+	if !hasDate && start.Before(now) {
+		// A time without a date refers to the next time it's that time.
+		start = start.AddDate(0, 0, 1)
+	}
+	return start, false, nil
+}
+
+// parseRelativeTime parses the part after "in" in times like "in 2 hours" or
+// "in 1 hour 30 minutes".
+func parseRelativeTime(words []string, now time.Time) (time.Time, error) {
+	if len(words) == 0 || len(words)%2 != 0 {
+		return time.Time{}, fmt.Errorf("expected an amount and a unit after \"in\"")
+	}
+	var total time.Duration
+	for i := 0; i < len(words); i += 2 {
+		amount, err := strconv.Atoi(words[i])
+		if words[i] == "a" || words[i] == "an" {
+			amount, err = 1, nil
+		}
+		unit, ok := relativeUnits[words[i+1]]
+		if err != nil || amount < 0 || !ok {
+			return time.Time{}, fmt.Errorf("unrecognized duration %q", words[i]+" "+words[i+1])
+		}
+		total += time.Duration(amount) * unit
+	}
+	return now.Add(total), nil
+}
+
+// parseClock parses a time of day like "7pm", "7:30am", "19:00", "noon" or
+// "midnight".
+func parseClock(word string) (hour, minute int, ok bool) {
+	switch word {
+	case "noon":
+		return 12, 0, true
+	case "midnight":
+		return 0, 0, true
+	}
+	meridiem := ""
+	if strings.HasSuffix(word, "am") || strings.HasSuffix(word, "pm") {
+		meridiem = word[len(word)-2:]
+		word = word[:len(word)-2]
+	}
+	hourStr, minuteStr, hasMinute := strings.Cut(word, ":")
+	if !hasMinute && len(meridiem) == 0 {
+		// Plain numbers are only times with am/pm, otherwise they're dates.
+		return 0, 0, false
+	}
+	hour, err := strconv.Atoi(hourStr)
+	if err != nil {
+		return 0, 0, false
+	}
+	if hasMinute {
+		minute, err = strconv.Atoi(minuteStr)
+		if err != nil || len(minuteStr) != 2 || minute > 59 {
+			return 0, 0, false
+		}
+	}
+	switch meridiem {
+	case "am", "pm":
+		if hour < 1 || hour > 12 {
+			return 0, 0, false
+		}
+		hour %= 12
+		if meridiem == "pm" {
+			hour += 12
+		}
+	default:
+		if hour > 23 {
+			return 0, 0, false
+		}
+	}
+	return hour, minute, true
+}
+
+var ordinalSuffixReplacer = strings.NewReplacer("st", "", "nd", "", "rd", "", "th", "")
+
+// parseDate parses a date like "2023-01-05", "1/5", "1/5/2023", "jan 5" or
+// "january 5th". Dates without a year that have passed refer to next year.
+func parseDate(word string, now time.Time) (time.Time, bool) {
+	if date, err := time.ParseInLocation("2006-01-02", word, now.Location()); err == nil {
+		return date, true
+	} else if date, err = time.ParseInLocation("1/2/2006", word, now.Location()); err == nil {
+		return date, true
+	}
+	var date time.Time
+	var err error
+	if strings.Contains(word, "/") {
+		date, err = time.ParseInLocation("1/2", word, now.Location())
+	} else if month, day, ok := strings.Cut(word, " "); ok {
+		day = ordinalSuffixReplacer.Replace(day)
+		// time.Parse is case sensitive, so month names are capitalized.
+		if len(month) > 0 {
+			month = strings.ToUpper(month[:1]) + month[1:]
+		}
+		date, err = time.ParseInLocation("Jan 2", month+" "+day, now.Location())
+		if err != nil {
+			date, err = time.ParseInLocation("January 2", month+" "+day, now.Location())
+		}
+	} else {
+		return time.Time{}, false
+	}
+	if err != nil {
+		return time.Time{}, false
+	}
+	date = time.Date(now.Year(), date.Month(), date.Day(), 0, 0, 0, 0, now.Location())
+	if date.Before(time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())) {
+		date = date.AddDate(1, 0, 0)
+	}
+	return date, true
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/beeper/groupme/groupmeext"
+)
+
+func TestParseEventTime(t *testing.T) {
+	// Wednesday
+	now := time.Date(2023, time.March, 15, 14, 30, 0, 0, time.UTC)
+	date := func(month time.Month, day, hour, minute int) time.Time {
+		year := 2023
+		if month < time.March {
+			year++
+		}
+		return time.Date(year, month, day, hour, minute, 0, 0, time.UTC)
+	}
+
+	tests := []struct {
+		input    string
+		expected time.Time
+		allDay   bool
+	}{
+		{"now", now, false},
+		{"in 2 hours", now.Add(2 * time.Hour), false},
+		{"in an hour 30 minutes", now.Add(90 * time.Minute), false},
+		{"tomorrow 7pm", date(time.March, 16, 19, 0), false},
+		{"tomorrow at 7:30 pm", date(time.March, 16, 19, 30), false},
+		{"today 18:00", date(time.March, 15, 18, 0), false},
+		{"9am", date(time.March, 16, 9, 0), false},
+		{"noon", date(time.March, 16, 12, 0), false},
+		{"friday", date(time.March, 17, 0, 0), true},
+		{"next wednesday at 12am", date(time.March, 22, 0, 0), false},
+		{"Mon 10:15", date(time.March, 20, 10, 15), false},
+		{"2023-04-01 8pm", date(time.April, 1, 20, 0), false},
+		{"4/1", date(time.April, 1, 0, 0), true},
+		{"jan 5th 6pm", date(time.January, 5, 18, 0), false},
+		{"December 24", date(time.December, 24, 0, 0), true},
+	}
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
+			start, allDay, err := parseEventTime(test.input, now)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !start.Equal(test.expected) || allDay != test.allDay {
+				t.Errorf("expected %s (all day: %t), got %s (all day: %t)", test.expected, test.allDay, start, allDay)
+			}
+		})
+	}
+
+	for _, input := range []string{"", "someday", "in 2 fortnights", "25:00", "13pm"} {
+		t.Run("invalid "+input, func(t *testing.T) {
+			if _, _, err := parseEventTime(input, now); err == nil {
+				t.Errorf("expected error for %q", input)
+			}
+		})
+	}
+}
+
+func TestSplitQuotedArgs(t *testing.T) {
+	args := splitQuotedArgs(`create "Board games" “friday 7pm” Sam's place`)
+	expected := []string{"create", "Board games", "friday 7pm", "Sam's", "place"}
+	if !reflect.DeepEqual(args, expected) {
+		t.Errorf("expected %q, got %q", expected, args)
+	}
+}
+
+func TestCalendarEventToICS(t *testing.T) {
+	createdAt := time.Date(2023, time.March, 1, 12, 0, 0, 0, time.UTC)
+	startAt := time.Date(2023, time.March, 17, 19, 0, 0, 0, time.UTC)
+	canceledAt := createdAt.Add(time.Hour)
+	ics := func(lines ...string) string {
+		lines = append([]string{
+			"BEGIN:VCALENDAR",
+			"VERSION:2.0",
+			"PRODID:-//mautrix-groupme//EN",
+			"BEGIN:VEVENT",
+			"UID:abc@groupme.com",
+			"DTSTAMP:20230301T120000Z",
+		}, lines...)
+		lines = append(lines, "END:VEVENT", "END:VCALENDAR")
+		return strings.Join(lines, "\r\n") + "\r\n"
+	}
+
+	tests := []struct {
+		name     string
+		evt      groupmeext.CalendarEvent
+		expected string
+	}{
+		{
+			"timed",
+			groupmeext.CalendarEvent{Name: "Board games", StartAt: startAt, EndAt: startAt.Add(2 * time.Hour)},
+			ics("DTSTART:20230317T190000Z", "DTEND:20230317T210000Z", "SUMMARY:Board games", "STATUS:CONFIRMED"),
+		},
+		{
+			"no end",
+			groupmeext.CalendarEvent{Name: "Board games", StartAt: startAt, EndAt: startAt},
+			ics("DTSTART:20230317T190000Z", "SUMMARY:Board games", "STATUS:CONFIRMED"),
+		},
+		{
+			"all day in timezone",
+			groupmeext.CalendarEvent{
+				Name:     "Trip",
+				IsAllDay: true,
+				Timezone: "America/Los_Angeles",
+				StartAt:  time.Date(2023, time.March, 18, 4, 0, 0, 0, time.UTC),
+				EndAt:    time.Date(2023, time.March, 18, 4, 0, 0, 0, time.UTC),
+			},
+			ics("DTSTART;VALUE=DATE:20230317", "DTEND;VALUE=DATE:20230318", "SUMMARY:Trip", "STATUS:CONFIRMED"),
+		},
+		{
+			"escaping",
+			groupmeext.CalendarEvent{Name: `a, b; c\d`, Description: "line 1\r\nline 2\n", StartAt: startAt},
+			ics("DTSTART:20230317T190000Z", `SUMMARY:a\, b\; c\\d`, `DESCRIPTION:line 1\nline 2\n`, "STATUS:CONFIRMED"),
+		},
+		{
+			"location and cancelled",
+			groupmeext.CalendarEvent{
+				Name:       "Dinner",
+				StartAt:    startAt,
+				Location:   &groupmeext.CalendarLocation{Name: "Sam's", Address: "1 Main St", Lat: "40.7", Lng: "-74.0"},
+				CanceledAt: &canceledAt,
+			},
+			ics("DTSTART:20230317T190000Z", "SUMMARY:Dinner", `LOCATION:Sam's\, 1 Main St`, "GEO:40.7;-74.0", "STATUS:CANCELLED"),
+		},
+		{
+			"location without address",
+			groupmeext.CalendarEvent{Name: "Dinner", StartAt: startAt, Location: &groupmeext.CalendarLocation{Name: "Sam's", Address: "Sam's"}},
+			ics("DTSTART:20230317T190000Z", "SUMMARY:Dinner", "LOCATION:Sam's", "STATUS:CONFIRMED"),
+		},
+		{
+			"fold ascii",
+			groupmeext.CalendarEvent{Name: strings.Repeat("a", 150), StartAt: startAt},
+			ics(
+				"DTSTART:20230317T190000Z",
+				"SUMMARY:"+strings.Repeat("a", 67),
+				" "+strings.Repeat("a", 74),
+				" "+strings.Repeat("a", 9),
+				"STATUS:CONFIRMED",
+			),
+		},
+		{
+			"fold two-byte runes",
+			groupmeext.CalendarEvent{Name: strings.Repeat("é", 40), StartAt: startAt},
+			ics("DTSTART:20230317T190000Z", "SUMMARY:"+strings.Repeat("é", 33), " "+strings.Repeat("é", 7), "STATUS:CONFIRMED"),
+		},
+		{
+			"fold four-byte runes",
+			groupmeext.CalendarEvent{Name: strings.Repeat("😀", 20), StartAt: startAt},
+			ics("DTSTART:20230317T190000Z", "SUMMARY:"+strings.Repeat("😀", 16), " "+strings.Repeat("😀", 4), "STATUS:CONFIRMED"),
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.evt.EventID = "abc"
+			test.evt.CreatedAt = createdAt
+			output := calendarEventToICS(&test.evt)
+			if output != test.expected {
+				t.Errorf("expected\n%q\ngot\n%q", test.expected, output)
+			}
+			for _, line := range strings.Split(strings.TrimSuffix(output, "\r\n"), "\r\n") {
+				if len(line) > 75 {
+					t.Errorf("line %q is longer than 75 octets", line)
+				} else if !utf8.ValidString(line) {
+					t.Errorf("line %q was folded inside a character", line)
+				}
+			}
+		})
+	}
+}
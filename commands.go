@@ -18,9 +18,24 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
+	"unicode"
 
+	"github.com/beeper/groupme-lib"
+	"github.com/gabriel-vasile/mimetype"
+
+	"maunium.net/go/mautrix"
 	"maunium.net/go/mautrix/bridge/commands"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/beeper/groupme/database"
+	"github.com/beeper/groupme/groupmeext"
 )
 
 type WrappedCommandEvent struct {
@@ -53,13 +68,15 @@ var (
 func (br *GMBridge) RegisterCommands() {
 	proc := br.CommandProcessor.(*commands.Processor)
 	proc.AddHandlers(
-		// cmdSetRelay,
-		// cmdUnsetRelay,
+		cmdSetRelay,
+		cmdUnsetRelay,
+		cmdOutbox,
+		cmdEvent,
 		// cmdInviteLink,
 		// cmdResolveLink,
 		// cmdJoin,
 		// cmdAccept,
-		// cmdCreate,
+		cmdCreate,
 		cmdLogin,
 		// cmdLogout,
 		// cmdTogglePresence,
@@ -80,6 +97,290 @@ func (br *GMBridge) RegisterCommands() {
 	)
 }
 
+var cmdSetRelay = &commands.FullHandler{
+	Func: wrapCommand(fnSetRelay),
+	Name: "set-relay",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionPortalManagement,
+		Description: "Relay messages in this room through your GroupMe account.",
+	},
+	RequiresPortal: true,
+	RequiresLogin:  true,
+}
+
+func fnSetRelay(ce *WrappedCommandEvent) {
+	if !ce.Bridge.Config.Bridge.Relay.Enabled {
+		ce.Reply("Relay mode is not enabled on this instance of the bridge")
+	} else if ce.Bridge.Config.Bridge.Relay.AdminOnly && !ce.User.Admin {
+		ce.Reply("Only admins are allowed to enable relay mode on this instance of the bridge")
+	} else if ce.Portal.IsPrivateChat() {
+		ce.Reply("Relay mode can only be used in group chats")
+	} else {
+		ce.Portal.RelayUserID = ce.User.MXID
+		ce.Portal.Update(nil)
+		ce.Reply("Messages from non-logged-in users in this room will now be bridged through your GroupMe account")
+	}
+}
+
+var cmdUnsetRelay = &commands.FullHandler{
+	Func: wrapCommand(fnUnsetRelay),
+	Name: "unset-relay",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionPortalManagement,
+		Description: "Stop relaying messages in this room.",
+	},
+	RequiresPortal: true,
+}
+
+func fnUnsetRelay(ce *WrappedCommandEvent) {
+	if !ce.Bridge.Config.Bridge.Relay.Enabled {
+		ce.Reply("Relay mode is not enabled on this instance of the bridge")
+	} else if ce.Bridge.Config.Bridge.Relay.AdminOnly && !ce.User.Admin {
+		ce.Reply("Only admins are allowed to disable relay mode on this instance of the bridge")
+	} else {
+		ce.Portal.RelayUserID = ""
+		ce.Portal.Update(nil)
+		ce.Reply("Messages from non-logged-in users will no longer be bridged in this room")
+	}
+}
+
+var cmdOutbox = &commands.FullHandler{
+	Func: wrapCommand(fnOutbox),
+	Name: "outbox",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionPortalManagement,
+		Description: "List messages in this room that failed to send to GroupMe, or retry or drop them.",
+		Args:        "[retry|drop <_id_|all>]",
+	},
+	RequiresPortal: true,
+}
+
+func fnOutbox(ce *WrappedCommandEvent) {
+	if len(ce.Args) == 0 {
+		queued := ce.Bridge.DB.Outbox.GetAllInChat(ce.Portal.Key)
+		failed := ce.Bridge.DB.Outbox.GetFailedInChat(ce.Portal.Key)
+		if len(failed) == 0 {
+			ce.Reply("There are %d messages waiting to be sent and none of them have failed", len(queued))
+			return
+		}
+		var out strings.Builder
+		_, _ = fmt.Fprintf(&out, "%d messages are waiting to be sent, %d of which have failed:\n\n", len(queued), len(failed))
+		for _, item := range failed {
+			_, _ = fmt.Fprintf(&out, "* `%d`: %s from %s, %d attempts, next at %s: %s\n",
+				item.ID, item.MXID, item.Sender, item.Attempts, item.NextAttempt.Format(time.RFC3339), item.LastError)
+		}
+		out.WriteString("\nUse `outbox retry <id>` to send a message now or `outbox drop <id>` to stop trying to send it.")
+		ce.Reply(out.String())
+		return
+	} else if len(ce.Args) < 2 || (ce.Args[0] != "retry" && ce.Args[0] != "drop") {
+		ce.Reply("**Usage:** `outbox [retry|drop <id|all>]`")
+		return
+	}
+
+	var items []*database.OutboxItem
+	if ce.Args[1] == "all" {
+		items = ce.Bridge.DB.Outbox.GetFailedInChat(ce.Portal.Key)
+	} else if itemID, err := strconv.ParseInt(ce.Args[1], 10, 64); err != nil {
+		ce.Reply("Invalid message ID %q", ce.Args[1])
+		return
+	} else if item := ce.Bridge.DB.Outbox.GetByID(itemID); item == nil || item.Chat != ce.Portal.Key {
+		ce.Reply("There's no message with ID %d in this room's outbox", itemID)
+		return
+	} else {
+		items = []*database.OutboxItem{item}
+	}
+
+	count := 0
+	for _, item := range items {
+		if item.Sender != ce.User.MXID && !ce.User.Admin {
+			continue
+		}
+		if ce.Args[0] == "retry" {
+			ce.Portal.RetryOutboxItem(item)
+		} else {
+			ce.Portal.DropOutboxItem(item)
+		}
+		count++
+	}
+	if count < len(items) {
+		ce.Reply("Only admins can retry or drop messages sent by other users")
+	}
+	if ce.Args[0] == "retry" {
+		ce.Reply("Retrying %d messages", count)
+	} else {
+		ce.Reply("Dropped %d messages", count)
+	}
+}
+
+var cmdEvent = &commands.FullHandler{
+	Func: wrapCommand(fnEvent),
+	Name: "event",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionPortalManagement,
+		Description: "Create, list or RSVP to events in the GroupMe calendar of this group. Put arguments that contain spaces in quotes.",
+		Args:        "<create _title_ _when_ [_location_]|list|rsvp _id_ going|not>",
+	},
+	RequiresPortal: true,
+	RequiresLogin:  true,
+}
+
+const eventCommandUsage = "**Usage:** `event create <title> <when> [location]`, `event list` or `event rsvp <id> going|not`"
+
+// defaultCalendarEventDuration is the length of events created with the
+// event command, as there's no way to specify the end time.
+const defaultCalendarEventDuration = time.Hour
+
+func fnEvent(ce *WrappedCommandEvent) {
+	if ce.Portal.IsPrivateChat() {
+		ce.Reply("Calendar events are only available in groups")
+		return
+	}
+	args := splitQuotedArgs(ce.RawArgs)
+	if len(args) == 0 {
+		ce.Reply(eventCommandUsage)
+		return
+	}
+	switch strings.ToLower(args[0]) {
+	case "create":
+		fnEventCreate(ce, args[1:])
+	case "list":
+		fnEventList(ce)
+	case "rsvp":
+		fnEventRSVP(ce, args[1:])
+	default:
+		ce.Reply(eventCommandUsage)
+	}
+}
+
+func fnEventCreate(ce *WrappedCommandEvent, args []string) {
+	if len(args) < 2 {
+		ce.Reply("**Usage:** `event create <title> <when> [location]`, e.g. `event create \"Board games\" \"friday 7pm\" \"Sam's place\"`")
+		return
+	}
+	loc := ce.Bridge.Config.Bridge.CalendarTimezone
+	now := time.Now().In(loc)
+	start, allDay, err := parseEventTime(args[1], now)
+	if err != nil {
+		ce.Reply("Failed to parse time %q: %v", args[1], err)
+		return
+	} else if !allDay && start.Before(now.Add(-time.Minute)) {
+		ce.Reply("%s is in the past", start.Format(time.RFC1123))
+		return
+	}
+	create := &groupmeext.CalendarEventCreate{
+		Name:      args[0],
+		StartAt:   start,
+		EndAt:     start.Add(defaultCalendarEventDuration),
+		IsAllDay:  allDay,
+		Timezone:  loc.String(),
+		Reminders: []int{},
+	}
+	if allDay {
+		create.EndAt = start.AddDate(0, 0, 1)
+	}
+	if loc == time.Local {
+		// GroupMe needs an IANA timezone name, which isn't known for the local timezone.
+		create.Timezone = "UTC"
+		create.StartAt, create.EndAt = create.StartAt.UTC(), create.EndAt.UTC()
+	}
+	if len(args) > 2 {
+		create.Location = &groupmeext.CalendarLocation{Name: strings.Join(args[2:], " ")}
+	}
+	evt, err := ce.User.Client.CreateCalendarEvent(context.TODO(), ce.Portal.Key.GMID, create)
+	if err != nil {
+		ce.Reply("Failed to create event: %v", err)
+		return
+	}
+	ce.Portal.queueCalendarEventResync(ce.User, evt.EventID)
+	ce.Reply("Created event **%s** (`%s`) for %s", evt.Name, evt.EventID, formatCalendarEventTime(evt))
+}
+
+func fnEventList(ce *WrappedCommandEvent) {
+	events, err := ce.User.Client.GetCalendarEvents(context.TODO(), ce.Portal.Key.GMID, 50)
+	if err != nil {
+		ce.Reply("Failed to get events: %v", err)
+		return
+	}
+	now := time.Now()
+	upcoming := events[:0]
+	for _, evt := range events {
+		if !evt.IsCanceled() && (evt.EndAt.After(now) || evt.StartAt.After(now)) {
+			upcoming = append(upcoming, evt)
+		}
+	}
+	if len(upcoming) == 0 {
+		ce.Reply("There are no upcoming events in this group")
+		return
+	}
+	sort.Slice(upcoming, func(i, j int) bool {
+		return upcoming[i].StartAt.Before(upcoming[j].StartAt)
+	})
+	var out strings.Builder
+	out.WriteString("Upcoming events:\n\n")
+	for _, evt := range upcoming {
+		_, _ = fmt.Fprintf(&out, "* `%s`: **%s**, %s (%d going, %d not going)\n",
+			evt.EventID, evt.Name, formatCalendarEventTime(evt), len(evt.Going), len(evt.NotGoing))
+	}
+	out.WriteString("\nUse `event rsvp <id> going|not` to answer.")
+	ce.Reply(out.String())
+}
+
+func fnEventRSVP(ce *WrappedCommandEvent, args []string) {
+	if len(args) != 2 {
+		ce.Reply("**Usage:** `event rsvp <id> going|not`")
+		return
+	}
+	var going bool
+	switch strings.ToLower(args[1]) {
+	case "going", "yes":
+		going = true
+	case "not", "not-going", "no":
+		going = false
+	default:
+		ce.Reply("**Usage:** `event rsvp <id> going|not`")
+		return
+	}
+	err := ce.User.Client.RSVPCalendarEvent(context.TODO(), ce.Portal.Key.GMID, args[0], going)
+	if err != nil {
+		ce.Reply("Failed to RSVP to event: %v", err)
+		return
+	}
+	ce.Portal.queueCalendarEventResync(ce.User, args[0])
+	if going {
+		ce.Reply("Marked you as going to the event")
+	} else {
+		ce.Reply("Marked you as not going to the event")
+	}
+}
+
+// splitQuotedArgs splits command arguments by whitespace, except inside
+// double quotes. Smart quotes are accepted too, as some clients replace
+// quotes with them.
+func splitQuotedArgs(raw string) (args []string) {
+	var current strings.Builder
+	inQuotes, hasArg := false, false
+	for _, r := range raw {
+		switch {
+		case r == '"' || r == '\u201c' || r == '\u201d':
+			inQuotes = !inQuotes
+			hasArg = true
+		case unicode.IsSpace(r) && !inQuotes:
+			if hasArg {
+				args = append(args, current.String())
+				current.Reset()
+				hasArg = false
+			}
+		default:
+			current.WriteRune(r)
+			hasArg = true
+		}
+	}
+	if hasArg {
+		args = append(args, current.String())
+	}
+	return
+}
+
 var cmdLogin = &commands.FullHandler{
 	Func: wrapCommand(fnLogin),
 	Name: "login",
@@ -161,3 +462,149 @@ func fnSync(ce *WrappedCommandEvent) {
 	ce.Reply("Sync started...")
 	go ce.User.HandleChatList()
 }
+
+var cmdCreate = &commands.FullHandler{
+	Func: wrapCommand(fnCreate),
+	Name: "create",
+	Help: commands.HelpMeta{
+		Section:     HelpSectionCreatingPortals,
+		Description: "Create a GroupMe group for the current Matrix room.",
+	},
+	RequiresLogin: true,
+}
+
+func fnCreate(ce *WrappedCommandEvent) {
+	if ce.Portal != nil {
+		ce.Reply("This is already a portal room")
+		return
+	}
+
+	members, err := ce.Bot.JoinedMembers(ce.RoomID)
+	if err != nil {
+		ce.Reply("Failed to get room members: %v", err)
+		return
+	}
+
+	var roomNameEvent event.RoomNameEventContent
+	err = ce.Bot.StateEvent(ce.RoomID, event.StateRoomName, "", &roomNameEvent)
+	if err != nil && !errors.Is(err, mautrix.MNotFound) {
+		ce.Log.Errorln("Failed to get room name to create group:", err)
+		ce.Reply("Failed to get room name")
+		return
+	} else if len(roomNameEvent.Name) == 0 {
+		ce.Reply("Please set a name for the room first")
+		return
+	}
+
+	var roomTopicEvent event.TopicEventContent
+	err = ce.Bot.StateEvent(ce.RoomID, event.StateTopic, "", &roomTopicEvent)
+	if err != nil && !errors.Is(err, mautrix.MNotFound) {
+		ce.Log.Warnln("Failed to get room topic to create group:", err)
+	}
+
+	var roomAvatarEvent event.RoomAvatarEventContent
+	var avatarURL string
+	err = ce.Bot.StateEvent(ce.RoomID, event.StateRoomAvatar, "", &roomAvatarEvent)
+	if err != nil && !errors.Is(err, mautrix.MNotFound) {
+		ce.Log.Warnln("Failed to get room avatar to create group:", err)
+	} else if !roomAvatarEvent.URL.IsEmpty() {
+		data, err := ce.Bot.DownloadBytes(roomAvatarEvent.URL)
+		if err != nil {
+			ce.Log.Warnln("Failed to download room avatar to create group:", err)
+		} else if avatarURL, err = groupmeext.UploadImage(data, mimetype.Detect(data).String(), ce.User.Token, ce.Log); err != nil {
+			ce.Log.Warnln("Failed to upload room avatar to create group:", err)
+		}
+	}
+
+	var encryptionEvent event.EncryptionEventContent
+	err = ce.Bot.StateEvent(ce.RoomID, event.StateEncryption, "", &encryptionEvent)
+	if err != nil && !errors.Is(err, mautrix.MNotFound) {
+		ce.Reply("Failed to get room encryption status")
+		return
+	}
+
+	var participants []*groupme.Member
+	participantDedup := map[groupme.ID]bool{ce.User.GMID: true}
+	for userID := range members.Joined {
+		gmid, ok := ce.Bridge.ParsePuppetMXID(userID)
+		if !ok {
+			if user := ce.Bridge.GetUserByMXIDIfExists(userID); user != nil {
+				gmid = user.GMID
+			}
+		}
+		if len(gmid) > 0 && !participantDedup[gmid] {
+			participantDedup[gmid] = true
+			participants = append(participants, &groupme.Member{
+				UserID:   gmid,
+				Nickname: ce.Bridge.GetPuppetByGMID(gmid).Displayname,
+			})
+		}
+	}
+
+	ce.Log.Infofln("Creating group for %s with name %s and %d participants", ce.RoomID, roomNameEvent.Name, len(participants))
+	group, err := ce.User.Client.CreateGroup(context.TODO(), groupme.GroupSettings{
+		Name:        roomNameEvent.Name,
+		Description: roomTopicEvent.Topic,
+		ImageURL:    avatarURL,
+	})
+	if err != nil {
+		ce.Reply("Failed to create group: %v", err)
+		return
+	}
+	if len(participants) > 0 {
+		_, err = ce.User.Client.AddMembers(context.TODO(), group.ID, participants...)
+		if err != nil {
+			ce.Reply("Failed to add room members to the group: %v", err)
+		}
+	}
+
+	portal := ce.Bridge.GetPortalByGMID(database.GroupPortalKey(group.ID))
+	portal.roomCreateLock.Lock()
+	defer portal.roomCreateLock.Unlock()
+	if len(portal.MXID) != 0 {
+		portal.log.Warnln("Detected race condition in room creation")
+		// TODO race condition, clean up the old room
+	}
+	portal.MXID = ce.RoomID
+	portal.Name = roomNameEvent.Name
+	portal.NameSet = true
+	portal.Topic = roomTopicEvent.Topic
+	portal.TopicSet = true
+	portal.Avatar = avatarURL
+	portal.AvatarURL = roomAvatarEvent.URL
+	portal.AvatarSet = len(avatarURL) > 0
+	portal.Encrypted = encryptionEvent.Algorithm == id.AlgorithmMegolmV1
+	if !portal.Encrypted && ce.Bridge.Config.Bridge.Encryption.Default {
+		_, err = portal.MainIntent().SendStateEvent(portal.MXID, event.StateEncryption, "", portal.GetEncryptionEventContent())
+		if err != nil {
+			portal.log.Warnln("Failed to enable encryption in room:", err)
+			if errors.Is(err, mautrix.MForbidden) {
+				ce.Reply("I don't seem to have permission to enable encryption in this room.")
+			} else {
+				ce.Reply("Failed to enable encryption in room: %v", err)
+			}
+		}
+		portal.Encrypted = true
+	}
+
+	levels, err := portal.MainIntent().PowerLevels(portal.MXID)
+	if err != nil {
+		levels = portal.GetBasePowerLevels()
+	} else if levels.Events == nil {
+		levels.Events = make(map[string]int)
+	}
+	for evtType, level := range portal.GetBasePowerLevels().Events {
+		levels.Events[evtType] = level
+	}
+	_, err = portal.MainIntent().SetPowerLevels(portal.MXID, levels)
+	if err != nil {
+		portal.log.Warnln("Failed to update power levels:", err)
+	}
+
+	portal.Update(nil)
+	ce.Bridge.portalsLock.Lock()
+	ce.Bridge.portalsByMXID[portal.MXID] = portal
+	ce.Bridge.portalsLock.Unlock()
+	portal.UpdateBridgeInfo()
+	ce.Reply("Successfully created GroupMe group %s", portal.Key.GMID)
+}
@@ -79,6 +79,12 @@ type BridgeConfig struct {
 	FederateRooms         bool `yaml:"federate_rooms"`
 	AllowUserInvite       bool `yaml:"allow_user_invite"`
 
+	PollExpiryStr string        `yaml:"poll_expiry"`
+	PollExpiry    time.Duration `yaml:"-"`
+
+	CalendarTimezoneStr string         `yaml:"calendar_timezone"`
+	CalendarTimezone    *time.Location `yaml:"-"`
+
 	MessageHandlingTimeout struct {
 		ErrorAfterStr string `yaml:"error_after"`
 		DeadlineStr   string `yaml:"deadline"`
@@ -89,6 +95,8 @@ type BridgeConfig struct {
 
 	CommandPrefix string `yaml:"command_prefix"`
 
+	Formatting FormattingConfig `yaml:"formatting"`
+
 	ManagementRoomText bridgeconfig.ManagementRoomTexts `yaml:"management_room_text"`
 
 	Encryption bridgeconfig.EncryptionConfig `yaml:"encryption"`
@@ -100,6 +108,8 @@ type BridgeConfig struct {
 
 	Permissions bridgeconfig.PermissionConfig `yaml:"permissions"`
 
+	Relay RelaybotConfig `yaml:"relay"`
+
 	ParsedUsernameTemplate *template.Template `yaml:"-"`
 	displaynameTemplate    *template.Template `yaml:"-"`
 }
@@ -178,6 +188,19 @@ func (bc *BridgeConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
 			return err
 		}
 	}
+	if bc.PollExpiryStr != "" {
+		bc.PollExpiry, err = time.ParseDuration(bc.PollExpiryStr)
+		if err != nil {
+			return err
+		}
+	}
+	bc.CalendarTimezone = time.Local
+	if bc.CalendarTimezoneStr != "" {
+		bc.CalendarTimezone, err = time.LoadLocation(bc.CalendarTimezoneStr)
+		if err != nil {
+			return err
+		}
+	}
 
 	return nil
 }
@@ -201,6 +224,17 @@ func (bc BridgeConfig) FormatUsername(username string) string {
 	return buf.String()
 }
 
+// FormattingConfig controls how Matrix HTML is rendered into the plain text
+// that GroupMe supports. Empty markers drop the formatting entirely.
+type FormattingConfig struct {
+	Bold             string `yaml:"bold"`
+	Italic           string `yaml:"italic"`
+	Strikethrough    string `yaml:"strikethrough"`
+	Monospace        string `yaml:"monospace"`
+	FencedCodeBlocks bool   `yaml:"fenced_code_blocks"`
+	LinkURLs         bool   `yaml:"link_urls"`
+}
+
 type RelaybotConfig struct {
 	Enabled          bool                         `yaml:"enabled"`
 	AdminOnly        bool                         `yaml:"admin_only"`
@@ -58,7 +58,15 @@ func DoUpgrade(helper *up.Helper) {
 	helper.Copy(up.Bool, "bridge", "disable_status_broadcast_send")
 	helper.Copy(up.Bool, "bridge", "mute_status_broadcast")
 	helper.Copy(up.Bool, "bridge", "allow_user_invite")
+	helper.Copy(up.Str, "bridge", "poll_expiry")
+	helper.Copy(up.Str|up.Null, "bridge", "calendar_timezone")
 	helper.Copy(up.Str, "bridge", "command_prefix")
+	helper.Copy(up.Str, "bridge", "formatting", "bold")
+	helper.Copy(up.Str, "bridge", "formatting", "italic")
+	helper.Copy(up.Str, "bridge", "formatting", "strikethrough")
+	helper.Copy(up.Str, "bridge", "formatting", "monospace")
+	helper.Copy(up.Bool, "bridge", "formatting", "fenced_code_blocks")
+	helper.Copy(up.Bool, "bridge", "formatting", "link_urls")
 	helper.Copy(up.Bool, "bridge", "federate_rooms")
 	helper.Copy(up.Bool, "bridge", "disappearing_messages_in_groups")
 	helper.Copy(up.Bool, "bridge", "disable_bridge_alerts")
@@ -109,6 +117,9 @@ func DoUpgrade(helper *up.Helper) {
 		helper.Copy(up.Str, "bridge", "provisioning", "shared_secret")
 	}
 	helper.Copy(up.Map, "bridge", "permissions")
+	helper.Copy(up.Bool, "bridge", "relay", "enabled")
+	helper.Copy(up.Bool, "bridge", "relay", "admin_only")
+	helper.Copy(up.Map, "bridge", "relay", "message_formats")
 }
 
 var SpacedBlocks = [][]string{
@@ -123,9 +134,11 @@ var SpacedBlocks = [][]string{
 	{"groupme"},
 	{"bridge"},
 	{"bridge", "command_prefix"},
+	{"bridge", "formatting"},
 	{"bridge", "management_room_text"},
 	{"bridge", "encryption"},
 	{"bridge", "provisioning"},
 	{"bridge", "permissions"},
+	{"bridge", "relay"},
 	{"logging"},
 }
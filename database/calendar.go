@@ -0,0 +1,160 @@
+// mautrix-groupme - A Matrix-GroupMe puppeting bridge.
+// Copyright (C) 2022 Sumner Evans, Karmanyaah Malhotra
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"database/sql"
+	"errors"
+
+	log "maunium.net/go/maulogger/v2"
+	"maunium.net/go/mautrix/id"
+	"maunium.net/go/mautrix/util/dbutil"
+
+	"github.com/beeper/groupme-lib"
+)
+
+type CalendarEventQuery struct {
+	db  *Database
+	log log.Logger
+}
+
+func (ceq *CalendarEventQuery) New() *CalendarEvent {
+	return &CalendarEvent{
+		db:  ceq.db,
+		log: ceq.log,
+	}
+}
+
+const (
+	getCalendarEventByIDQuery = `
+		SELECT chat_gmid, chat_receiver, event_id, mxid, ics_mxid, body, ics FROM calendar_event
+		WHERE chat_gmid=$1 AND chat_receiver=$2 AND event_id=$3
+	`
+	insertCalendarEventQuery = `
+		INSERT INTO calendar_event (chat_gmid, chat_receiver, event_id, mxid, ics_mxid, body, ics)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+	`
+	updateCalendarEventQuery = `
+		UPDATE calendar_event SET ics_mxid=$1, body=$2, ics=$3
+		WHERE chat_gmid=$4 AND chat_receiver=$5 AND event_id=$6
+	`
+
+	getCalendarRSVPsQuery = `
+		SELECT user_gmid, going, mxid FROM calendar_rsvp
+		WHERE chat_gmid=$1 AND chat_receiver=$2 AND event_id=$3
+	`
+	upsertCalendarRSVPQuery = `
+		INSERT INTO calendar_rsvp (chat_gmid, chat_receiver, event_id, user_gmid, going, mxid)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (chat_gmid, chat_receiver, event_id, user_gmid)
+			DO UPDATE SET going=excluded.going, mxid=excluded.mxid
+	`
+	deleteCalendarRSVPQuery = `
+		DELETE FROM calendar_rsvp
+		WHERE chat_gmid=$1 AND chat_receiver=$2 AND event_id=$3 AND user_gmid=$4
+	`
+)
+
+func (ceq *CalendarEventQuery) GetByEventID(chat PortalKey, eventID string) *CalendarEvent {
+	row := ceq.db.QueryRow(getCalendarEventByIDQuery, chat.GMID, chat.Receiver, eventID)
+	if row == nil {
+		return nil
+	}
+	return ceq.New().Scan(row)
+}
+
+// CalendarEvent is a GroupMe calendar event that has been bridged to Matrix
+// as a message. Body and ICS are what was last sent to Matrix, so that the
+// message is only edited when the event actually changes.
+type CalendarEvent struct {
+	db  *Database
+	log log.Logger
+
+	Chat    PortalKey
+	EventID string
+	MXID    id.EventID
+	ICSMXID id.EventID
+	Body    string
+	ICS     string
+}
+
+func (ce *CalendarEvent) Scan(row dbutil.Scannable) *CalendarEvent {
+	err := row.Scan(&ce.Chat.GMID, &ce.Chat.Receiver, &ce.EventID, &ce.MXID, &ce.ICSMXID, &ce.Body, &ce.ICS)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			ce.log.Errorln("Database scan failed:", err)
+		}
+		return nil
+	}
+	return ce
+}
+
+func (ce *CalendarEvent) Insert() {
+	_, err := ce.db.Exec(insertCalendarEventQuery, ce.Chat.GMID, ce.Chat.Receiver, ce.EventID, ce.MXID, ce.ICSMXID, ce.Body, ce.ICS)
+	if err != nil {
+		ce.log.Warnfln("Failed to insert calendar event %s@%s: %v", ce.Chat, ce.EventID, err)
+	}
+}
+
+func (ce *CalendarEvent) Update() {
+	_, err := ce.db.Exec(updateCalendarEventQuery, ce.ICSMXID, ce.Body, ce.ICS, ce.Chat.GMID, ce.Chat.Receiver, ce.EventID)
+	if err != nil {
+		ce.log.Warnfln("Failed to update calendar event %s@%s: %v", ce.Chat, ce.EventID, err)
+	}
+}
+
+// CalendarRSVP is the RSVP of a GroupMe user to a calendar event that was
+// bridged to Matrix as a reaction.
+type CalendarRSVP struct {
+	User  groupme.ID
+	Going bool
+	MXID  id.EventID
+}
+
+// GetRSVPs returns the bridged RSVPs to the event by user.
+func (ce *CalendarEvent) GetRSVPs() map[groupme.ID]*CalendarRSVP {
+	rows, err := ce.db.Query(getCalendarRSVPsQuery, ce.Chat.GMID, ce.Chat.Receiver, ce.EventID)
+	if err != nil || rows == nil {
+		return nil
+	}
+	defer rows.Close()
+	rsvps := make(map[groupme.ID]*CalendarRSVP)
+	for rows.Next() {
+		var rsvp CalendarRSVP
+		err = rows.Scan(&rsvp.User, &rsvp.Going, &rsvp.MXID)
+		if err != nil {
+			ce.log.Errorln("Database scan failed:", err)
+			continue
+		}
+		rsvps[rsvp.User] = &rsvp
+	}
+	return rsvps
+}
+
+func (ce *CalendarEvent) UpsertRSVP(rsvp *CalendarRSVP) {
+	_, err := ce.db.Exec(upsertCalendarRSVPQuery, ce.Chat.GMID, ce.Chat.Receiver, ce.EventID, rsvp.User, rsvp.Going, rsvp.MXID)
+	if err != nil {
+		ce.log.Warnfln("Failed to upsert RSVP of %s to calendar event %s@%s: %v", rsvp.User, ce.Chat, ce.EventID, err)
+	}
+}
+
+func (ce *CalendarEvent) DeleteRSVP(user groupme.ID) {
+	_, err := ce.db.Exec(deleteCalendarRSVPQuery, ce.Chat.GMID, ce.Chat.Receiver, ce.EventID, user)
+	if err != nil {
+		ce.log.Warnfln("Failed to delete RSVP of %s to calendar event %s@%s: %v", user, ce.Chat, ce.EventID, err)
+	}
+}
@@ -38,6 +38,10 @@ type Database struct {
 	Puppet   *PuppetQuery
 	Message  *MessageQuery
 	Reaction *ReactionQuery
+	Outbox   *OutboxQuery
+	Poll     *PollQuery
+	Calendar *CalendarEventQuery
+	Emoji    *PowerupEmojiQuery
 }
 
 func New(baseDB *dbutil.Database, log maulogger.Logger) *Database {
@@ -63,6 +67,22 @@ func New(baseDB *dbutil.Database, log maulogger.Logger) *Database {
 		db:  db,
 		log: log.Sub("Reaction"),
 	}
+	db.Outbox = &OutboxQuery{
+		db:  db,
+		log: log.Sub("Outbox"),
+	}
+	db.Poll = &PollQuery{
+		db:  db,
+		log: log.Sub("Poll"),
+	}
+	db.Calendar = &CalendarEventQuery{
+		db:  db,
+		log: log.Sub("Calendar"),
+	}
+	db.Emoji = &PowerupEmojiQuery{
+		db:  db,
+		log: log.Sub("Emoji"),
+	}
 	return db
 }
 
@@ -0,0 +1,109 @@
+// mautrix-groupme - A Matrix-GroupMe puppeting bridge.
+// Copyright (C) 2022 Sumner Evans, Karmanyaah Malhotra
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"database/sql"
+	"errors"
+
+	log "maunium.net/go/maulogger/v2"
+	"maunium.net/go/mautrix/id"
+	"maunium.net/go/mautrix/util/dbutil"
+)
+
+type PowerupEmojiQuery struct {
+	db  *Database
+	log log.Logger
+}
+
+func (peq *PowerupEmojiQuery) New() *PowerupEmoji {
+	return &PowerupEmoji{
+		db:  peq.db,
+		log: peq.log,
+	}
+}
+
+const (
+	getPowerupEmojiSelect       = "SELECT pack_id, pack_index, mxc, name FROM powerup_emoji "
+	getPowerupEmojiByIndexQuery = getPowerupEmojiSelect + "WHERE pack_id=$1 AND pack_index=$2"
+	getPowerupEmojiByMXCQuery   = getPowerupEmojiSelect + "WHERE mxc=$1"
+	getPowerupEmojiPackQuery    = getPowerupEmojiSelect + "WHERE pack_id=$1 ORDER BY pack_index"
+	insertPowerupEmojiQuery     = `
+		INSERT INTO powerup_emoji (pack_id, pack_index, mxc, name) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (pack_id, pack_index) DO UPDATE SET mxc=excluded.mxc, name=excluded.name
+	`
+)
+
+func (peq *PowerupEmojiQuery) GetByIndex(packID, packIndex int) *PowerupEmoji {
+	return peq.maybeScan(peq.db.QueryRow(getPowerupEmojiByIndexQuery, packID, packIndex))
+}
+
+func (peq *PowerupEmojiQuery) GetByMXC(mxc id.ContentURIString) *PowerupEmoji {
+	return peq.maybeScan(peq.db.QueryRow(getPowerupEmojiByMXCQuery, mxc))
+}
+
+// GetPack returns the uploaded emojis of a pack ordered by their index.
+func (peq *PowerupEmojiQuery) GetPack(packID int) (emojis []*PowerupEmoji) {
+	rows, err := peq.db.Query(getPowerupEmojiPackQuery, packID)
+	if err != nil || rows == nil {
+		return nil
+	}
+	defer rows.Close()
+	for rows.Next() {
+		if emoji := peq.New().Scan(rows); emoji != nil {
+			emojis = append(emojis, emoji)
+		}
+	}
+	return
+}
+
+func (peq *PowerupEmojiQuery) maybeScan(row *sql.Row) *PowerupEmoji {
+	if row == nil {
+		return nil
+	}
+	return peq.New().Scan(row)
+}
+
+// PowerupEmoji is an emoji of a GroupMe powerup pack that has been uploaded to
+// the Matrix media repo.
+type PowerupEmoji struct {
+	db  *Database
+	log log.Logger
+
+	PackID    int
+	PackIndex int
+	MXC       id.ContentURIString
+	Name      string
+}
+
+func (pe *PowerupEmoji) Scan(row dbutil.Scannable) *PowerupEmoji {
+	err := row.Scan(&pe.PackID, &pe.PackIndex, &pe.MXC, &pe.Name)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			pe.log.Errorln("Database scan failed:", err)
+		}
+		return nil
+	}
+	return pe
+}
+
+func (pe *PowerupEmoji) Insert() {
+	_, err := pe.db.Exec(insertPowerupEmojiQuery, pe.PackID, pe.PackIndex, pe.MXC, pe.Name)
+	if err != nil {
+		pe.log.Warnfln("Failed to insert emoji %d/%d: %v", pe.PackID, pe.PackIndex, err)
+	}
+}
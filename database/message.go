@@ -42,14 +42,17 @@ func (mq *MessageQuery) New() *Message {
 
 const (
 	getAllMessagesSelect = `
-		SELECT chat_gmid, chat_receiver, gmid, mxid, sender, timestamp, sent
-		FROM messages
+		SELECT chat_gmid, chat_receiver, gmid, mxid, part, sender, timestamp, sent, source_guid
+		FROM message
 	`
 	getAllMessagesQuery = getAllMessagesSelect + `
 		WHERE chat_gmid=$1 AND chat_receiver=$2
 	`
-	getByGMIDQuery            = getAllMessagesQuery + "AND jid=$3"
-	getByMXIDQuery            = getAllMessagesSelect + "WHERE mxid=$1"
+	getByGMIDQuery            = getAllMessagesQuery + "AND gmid=$3 ORDER BY part ASC LIMIT 1"
+	getAllByGMIDQuery         = getAllMessagesQuery + "AND gmid=$3 ORDER BY part ASC"
+	getBySourceGUIDQuery      = getAllMessagesQuery + "AND source_guid=$3"
+	getByMXIDQuery            = getAllMessagesSelect + "WHERE mxid=$1 ORDER BY part ASC LIMIT 1"
+	getAllByMXIDQuery         = getAllMessagesSelect + "WHERE mxid=$1 ORDER BY part ASC"
 	getLastMessageInChatQuery = getAllMessagesQuery + `
 		AND timestamp<=$3 AND sent=true
 		ORDER BY timestamp DESC
@@ -64,6 +67,17 @@ const (
 		AND timestamp>$3 AND timestamp<=$4 AND sent=true
 		ORDER BY timestamp ASC
 	`
+	insertMessageQuery = `
+		INSERT INTO message (chat_gmid, chat_receiver, gmid, mxid, part, sender, timestamp, sent, source_guid)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+	`
+	markMessageSentQuery = `
+		UPDATE message SET gmid=$1, timestamp=$2, sent=true
+		WHERE chat_gmid=$3 AND chat_receiver=$4 AND source_guid=$5
+	`
+	deleteMessageQuery = `
+		DELETE FROM message WHERE chat_gmid=$1 AND chat_receiver=$2 AND gmid=$3
+	`
 )
 
 func (mq *MessageQuery) GetAll(chat PortalKey) (messages []*Message) {
@@ -77,14 +91,45 @@ func (mq *MessageQuery) GetAll(chat PortalKey) (messages []*Message) {
 	return
 }
 
+// GetByGMID returns the main part of a GroupMe message, which is the Matrix
+// event that replies and reactions target.
 func (mq *MessageQuery) GetByGMID(chat PortalKey, gmid groupme.ID) *Message {
 	return mq.maybeScan(mq.db.QueryRow(getByGMIDQuery, chat.GMID, chat.Receiver, gmid))
 }
 
+// GetAllByGMID returns all the Matrix events that a GroupMe message was bridged as.
+func (mq *MessageQuery) GetAllByGMID(chat PortalKey, gmid groupme.ID) (messages []*Message) {
+	rows, err := mq.db.Query(getAllByGMIDQuery, chat.GMID, chat.Receiver, gmid)
+	if err != nil || rows == nil {
+		return nil
+	}
+	for rows.Next() {
+		messages = append(messages, mq.New().Scan(rows))
+	}
+	return
+}
+
+// GetBySourceGUID finds a message sent from Matrix by the source GUID it was sent with.
+func (mq *MessageQuery) GetBySourceGUID(chat PortalKey, guid string) *Message {
+	return mq.maybeScan(mq.db.QueryRow(getBySourceGUIDQuery, chat.GMID, chat.Receiver, guid))
+}
+
 func (mq *MessageQuery) GetByMXID(mxid id.EventID) *Message {
 	return mq.maybeScan(mq.db.QueryRow(getByMXIDQuery, mxid))
 }
 
+// GetAllByMXID returns all the GroupMe messages that a Matrix event was split into.
+func (mq *MessageQuery) GetAllByMXID(mxid id.EventID) (messages []*Message) {
+	rows, err := mq.db.Query(getAllByMXIDQuery, mxid)
+	if err != nil || rows == nil {
+		return nil
+	}
+	for rows.Next() {
+		messages = append(messages, mq.New().Scan(rows))
+	}
+	return
+}
+
 func (mq *MessageQuery) GetLastInChat(chat PortalKey) *Message {
 	return mq.GetLastInChatBefore(chat, time.Now().Add(60*time.Second))
 }
@@ -122,16 +167,22 @@ type Message struct {
 	Chat      PortalKey
 	GMID      groupme.ID
 	MXID      id.EventID
+	Part      int
 	Sender    groupme.ID
 	Timestamp time.Time
 	Sent      bool
 
+	// SourceGUID is the source_guid a message from Matrix was sent to GroupMe
+	// with. It's used to recognize the message when GroupMe echoes it back.
+	SourceGUID string
+
 	Portal Portal
 }
 
 func (msg *Message) Scan(row dbutil.Scannable) *Message {
 	var ts int64
-	err := row.Scan(&msg.Chat.GMID, &msg.Chat.Receiver, &msg.GMID, &msg.MXID, &msg.Sender, &ts, &msg.Sent)
+	var sourceGUID sql.NullString
+	err := row.Scan(&msg.Chat.GMID, &msg.Chat.Receiver, &msg.GMID, &msg.MXID, &msg.Part, &msg.Sender, &ts, &msg.Sent, &sourceGUID)
 	if err != nil {
 		if !errors.Is(err, sql.ErrNoRows) {
 			msg.log.Errorln("Database scan failed:", err)
@@ -141,5 +192,45 @@ func (msg *Message) Scan(row dbutil.Scannable) *Message {
 	if ts != 0 {
 		msg.Timestamp = time.Unix(ts, 0)
 	}
+	msg.SourceGUID = sourceGUID.String
 	return msg
 }
+
+func (msg *Message) sourceGUIDPtr() *string {
+	if len(msg.SourceGUID) > 0 {
+		return &msg.SourceGUID
+	}
+	return nil
+}
+
+func (msg *Message) Insert(txn dbutil.Execable) {
+	if txn == nil {
+		txn = msg.db
+	}
+	_, err := txn.Exec(insertMessageQuery, msg.Chat.GMID, msg.Chat.Receiver, msg.GMID, msg.MXID, msg.Part, msg.Sender, msg.Timestamp.Unix(), msg.Sent, msg.sourceGUIDPtr())
+	if err != nil {
+		msg.log.Warnfln("Failed to insert %s@%s: %v", msg.Chat, msg.GMID, err)
+	}
+}
+
+// MarkSent stores the real GroupMe ID and timestamp of a message that was
+// inserted as pending before it was sent.
+func (msg *Message) MarkSent(gmid groupme.ID, ts time.Time) {
+	_, err := msg.db.Exec(markMessageSentQuery, gmid, ts.Unix(), msg.Chat.GMID, msg.Chat.Receiver, msg.SourceGUID)
+	if err != nil {
+		msg.log.Warnfln("Failed to mark %s@%s as sent: %v", msg.Chat, msg.SourceGUID, err)
+		return
+	}
+	msg.GMID = gmid
+	msg.Timestamp = ts
+	msg.Sent = true
+}
+
+// Delete removes the message from the database, including all the other parts
+// of the same GroupMe message.
+func (msg *Message) Delete() {
+	_, err := msg.db.Exec(deleteMessageQuery, msg.Chat.GMID, msg.Chat.Receiver, msg.GMID)
+	if err != nil {
+		msg.log.Warnfln("Failed to delete %s@%s: %v", msg.Chat, msg.GMID, err)
+	}
+}
@@ -0,0 +1,205 @@
+// mautrix-groupme - A Matrix-GroupMe puppeting bridge.
+// Copyright (C) 2022 Sumner Evans, Karmanyaah Malhotra
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+
+	log "maunium.net/go/maulogger/v2"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+	"maunium.net/go/mautrix/util/dbutil"
+)
+
+type OutboxQuery struct {
+	db  *Database
+	log log.Logger
+}
+
+func (oq *OutboxQuery) New() *OutboxItem {
+	return &OutboxItem{
+		db:  oq.db,
+		log: oq.log,
+	}
+}
+
+const (
+	outboxColumns        = "id, chat_gmid, chat_receiver, mxid, sender, event, attempts, next_attempt, last_error"
+	getOutboxSelect      = "SELECT " + outboxColumns + " FROM outbox "
+	getOutboxByIDQuery   = getOutboxSelect + "WHERE id=$1"
+	getOutboxByMXIDQuery = getOutboxSelect + "WHERE mxid=$1"
+	getOutboxInChatQuery = getOutboxSelect + `
+		WHERE chat_gmid=$1 AND chat_receiver=$2
+		ORDER BY id ASC
+	`
+	getNextOutboxItemQuery     = getOutboxInChatQuery + "LIMIT 1"
+	getFailedOutboxInChatQuery = getOutboxSelect + `
+		WHERE chat_gmid=$1 AND chat_receiver=$2 AND attempts>0
+		ORDER BY id ASC
+	`
+	getOutboxChatsQuery   = "SELECT DISTINCT chat_gmid, chat_receiver FROM outbox"
+	insertOutboxItemQuery = `
+		INSERT INTO outbox (chat_gmid, chat_receiver, mxid, sender, event, attempts, next_attempt, last_error)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		ON CONFLICT (mxid) DO NOTHING
+	`
+	updateOutboxItemQuery = `
+		UPDATE outbox SET attempts=$1, next_attempt=$2, last_error=$3 WHERE id=$4
+	`
+	deleteOutboxItemQuery = "DELETE FROM outbox WHERE id=$1"
+)
+
+// GetNext returns the oldest queued message in a chat. Messages are always
+// sent in the order they were queued in.
+func (oq *OutboxQuery) GetNext(chat PortalKey) *OutboxItem {
+	return oq.maybeScan(oq.db.QueryRow(getNextOutboxItemQuery, chat.GMID, chat.Receiver))
+}
+
+func (oq *OutboxQuery) GetByID(itemID int64) *OutboxItem {
+	return oq.maybeScan(oq.db.QueryRow(getOutboxByIDQuery, itemID))
+}
+
+func (oq *OutboxQuery) GetByMXID(mxid id.EventID) *OutboxItem {
+	return oq.maybeScan(oq.db.QueryRow(getOutboxByMXIDQuery, mxid))
+}
+
+func (oq *OutboxQuery) GetAllInChat(chat PortalKey) []*OutboxItem {
+	return oq.getAll(getOutboxInChatQuery, chat.GMID, chat.Receiver)
+}
+
+// GetFailedInChat returns the queued messages in a chat that have failed to
+// send at least once.
+func (oq *OutboxQuery) GetFailedInChat(chat PortalKey) []*OutboxItem {
+	return oq.getAll(getFailedOutboxInChatQuery, chat.GMID, chat.Receiver)
+}
+
+// GetChats returns the keys of all chats that have queued messages.
+func (oq *OutboxQuery) GetChats() (chats []PortalKey) {
+	rows, err := oq.db.Query(getOutboxChatsQuery)
+	if err != nil || rows == nil {
+		return nil
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var chat PortalKey
+		err = rows.Scan(&chat.GMID, &chat.Receiver)
+		if err != nil {
+			oq.log.Errorln("Database scan failed:", err)
+			continue
+		}
+		chats = append(chats, chat)
+	}
+	return
+}
+
+func (oq *OutboxQuery) getAll(query string, args ...interface{}) (items []*OutboxItem) {
+	rows, err := oq.db.Query(query, args...)
+	if err != nil || rows == nil {
+		return nil
+	}
+	defer rows.Close()
+	for rows.Next() {
+		if item := oq.New().Scan(rows); item != nil {
+			items = append(items, item)
+		}
+	}
+	return
+}
+
+func (oq *OutboxQuery) maybeScan(row *sql.Row) *OutboxItem {
+	if row == nil {
+		return nil
+	}
+	return oq.New().Scan(row)
+}
+
+// OutboxItem is a Matrix message that is waiting to be sent to GroupMe.
+type OutboxItem struct {
+	db  *Database
+	log log.Logger
+
+	ID          int64
+	Chat        PortalKey
+	MXID        id.EventID
+	Sender      id.UserID
+	Event       *event.Event
+	Attempts    int
+	NextAttempt time.Time
+	LastError   string
+}
+
+func (item *OutboxItem) Scan(row dbutil.Scannable) *OutboxItem {
+	var evtData []byte
+	var nextAttempt int64
+	var lastError sql.NullString
+	err := row.Scan(&item.ID, &item.Chat.GMID, &item.Chat.Receiver, &item.MXID, &item.Sender, &evtData, &item.Attempts, &nextAttempt, &lastError)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			item.log.Errorln("Database scan failed:", err)
+		}
+		return nil
+	}
+	item.NextAttempt = time.UnixMilli(nextAttempt)
+	item.LastError = lastError.String
+
+	item.Event = &event.Event{}
+	err = json.Unmarshal(evtData, item.Event)
+	if err == nil {
+		err = item.Event.Content.ParseRaw(item.Event.Type)
+	}
+	if err != nil {
+		item.log.Errorfln("Failed to parse queued event %s: %v", item.MXID, err)
+		item.Event = nil
+	}
+	return item
+}
+
+func (item *OutboxItem) lastErrorPtr() *string {
+	if len(item.LastError) > 0 {
+		return &item.LastError
+	}
+	return nil
+}
+
+// Insert adds the item to the outbox. Events that are already queued are ignored.
+func (item *OutboxItem) Insert() error {
+	evtData, err := json.Marshal(item.Event)
+	if err != nil {
+		return err
+	}
+	_, err = item.db.Exec(insertOutboxItemQuery,
+		item.Chat.GMID, item.Chat.Receiver, item.MXID, item.Sender, string(evtData),
+		item.Attempts, item.NextAttempt.UnixMilli(), item.lastErrorPtr())
+	return err
+}
+
+func (item *OutboxItem) Update() {
+	_, err := item.db.Exec(updateOutboxItemQuery, item.Attempts, item.NextAttempt.UnixMilli(), item.lastErrorPtr(), item.ID)
+	if err != nil {
+		item.log.Warnfln("Failed to update outbox item %d: %v", item.ID, err)
+	}
+}
+
+func (item *OutboxItem) Delete() {
+	_, err := item.db.Exec(deleteOutboxItemQuery, item.ID)
+	if err != nil {
+		item.log.Warnfln("Failed to delete outbox item %d: %v", item.ID, err)
+	}
+}
@@ -0,0 +1,210 @@
+// mautrix-groupme - A Matrix-GroupMe puppeting bridge.
+// Copyright (C) 2022 Sumner Evans, Karmanyaah Malhotra
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"strings"
+
+	log "maunium.net/go/maulogger/v2"
+	"maunium.net/go/mautrix/id"
+	"maunium.net/go/mautrix/util/dbutil"
+
+	"github.com/beeper/groupme-lib"
+)
+
+type PollQuery struct {
+	db  *Database
+	log log.Logger
+}
+
+func (pq *PollQuery) New() *Poll {
+	return &Poll{
+		db:  pq.db,
+		log: pq.log,
+	}
+}
+
+const (
+	getPollSelect           = "SELECT chat_gmid, chat_receiver, poll_id, mxid, owner, ended, answer_ids FROM poll "
+	getPollByPollIDQuery    = getPollSelect + "WHERE chat_gmid=$1 AND chat_receiver=$2 AND poll_id=$3"
+	getPollByMXIDQuery      = getPollSelect + "WHERE mxid=$1"
+	getOpenPollsInChatQuery = getPollSelect + "WHERE chat_gmid=$1 AND chat_receiver=$2 AND ended=false"
+	insertPollQuery         = `
+		INSERT INTO poll (chat_gmid, chat_receiver, poll_id, mxid, owner, ended, answer_ids)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+	`
+	updatePollQuery = "UPDATE poll SET ended=$1 WHERE chat_gmid=$2 AND chat_receiver=$3 AND poll_id=$4"
+
+	getPollVotesQuery = `
+		SELECT voter, answers, mxid FROM poll_vote
+		WHERE chat_gmid=$1 AND chat_receiver=$2 AND poll_id=$3
+	`
+	upsertPollVoteQuery = `
+		INSERT INTO poll_vote (chat_gmid, chat_receiver, poll_id, voter, answers, mxid)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (chat_gmid, chat_receiver, poll_id, voter)
+			DO UPDATE SET answers=excluded.answers, mxid=excluded.mxid
+	`
+)
+
+func (pq *PollQuery) GetByPollID(chat PortalKey, pollID groupme.ID) *Poll {
+	return pq.maybeScan(pq.db.QueryRow(getPollByPollIDQuery, chat.GMID, chat.Receiver, pollID))
+}
+
+func (pq *PollQuery) GetByMXID(mxid id.EventID) *Poll {
+	return pq.maybeScan(pq.db.QueryRow(getPollByMXIDQuery, mxid))
+}
+
+// GetOpenInChat returns the polls in a chat that haven't been ended yet.
+func (pq *PollQuery) GetOpenInChat(chat PortalKey) (polls []*Poll) {
+	rows, err := pq.db.Query(getOpenPollsInChatQuery, chat.GMID, chat.Receiver)
+	if err != nil || rows == nil {
+		return nil
+	}
+	defer rows.Close()
+	for rows.Next() {
+		if poll := pq.New().Scan(rows); poll != nil {
+			polls = append(polls, poll)
+		}
+	}
+	return
+}
+
+func (pq *PollQuery) maybeScan(row *sql.Row) *Poll {
+	if row == nil {
+		return nil
+	}
+	return pq.New().Scan(row)
+}
+
+// Poll is a GroupMe poll that has been bridged to a Matrix poll.
+type Poll struct {
+	db  *Database
+	log log.Logger
+
+	Chat   PortalKey
+	PollID groupme.ID
+	MXID   id.EventID
+	Owner  groupme.ID
+	Ended  bool
+
+	// AnswerIDs maps the Matrix answer IDs of a poll created on Matrix to
+	// the GroupMe option IDs. Polls created on GroupMe use the option IDs
+	// as answer IDs, so the map is empty for them.
+	AnswerIDs map[string]string
+}
+
+func (poll *Poll) Scan(row dbutil.Scannable) *Poll {
+	var answerIDs string
+	err := row.Scan(&poll.Chat.GMID, &poll.Chat.Receiver, &poll.PollID, &poll.MXID, &poll.Owner, &poll.Ended, &answerIDs)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			poll.log.Errorln("Database scan failed:", err)
+		}
+		return nil
+	}
+	if len(answerIDs) > 0 {
+		err = json.Unmarshal([]byte(answerIDs), &poll.AnswerIDs)
+		if err != nil {
+			poll.log.Warnfln("Failed to parse answer IDs of poll %s@%s: %v", poll.Chat, poll.PollID, err)
+		}
+	}
+	return poll
+}
+
+func (poll *Poll) answerIDsString() string {
+	if len(poll.AnswerIDs) == 0 {
+		return ""
+	}
+	data, _ := json.Marshal(poll.AnswerIDs)
+	return string(data)
+}
+
+// GetOptionID returns the GroupMe option ID of a Matrix answer ID.
+func (poll *Poll) GetOptionID(answerID string) (string, bool) {
+	if poll.AnswerIDs == nil {
+		return answerID, true
+	}
+	optionID, ok := poll.AnswerIDs[answerID]
+	return optionID, ok
+}
+
+// GetAnswerID returns the Matrix answer ID of a GroupMe option ID.
+func (poll *Poll) GetAnswerID(optionID string) string {
+	for answerID, id := range poll.AnswerIDs {
+		if id == optionID {
+			return answerID
+		}
+	}
+	return optionID
+}
+
+func (poll *Poll) Insert() {
+	_, err := poll.db.Exec(insertPollQuery, poll.Chat.GMID, poll.Chat.Receiver, poll.PollID, poll.MXID, poll.Owner, poll.Ended, poll.answerIDsString())
+	if err != nil {
+		poll.log.Warnfln("Failed to insert poll %s@%s: %v", poll.Chat, poll.PollID, err)
+	}
+}
+
+func (poll *Poll) Update() {
+	_, err := poll.db.Exec(updatePollQuery, poll.Ended, poll.Chat.GMID, poll.Chat.Receiver, poll.PollID)
+	if err != nil {
+		poll.log.Warnfln("Failed to update poll %s@%s: %v", poll.Chat, poll.PollID, err)
+	}
+}
+
+// PollVote is the last set of answers of a GroupMe user that was bridged
+// to Matrix as a poll response.
+type PollVote struct {
+	Voter   groupme.ID
+	Answers []string
+	MXID    id.EventID
+}
+
+// GetVotes returns the bridged votes in the poll by voter.
+func (poll *Poll) GetVotes() map[groupme.ID]*PollVote {
+	rows, err := poll.db.Query(getPollVotesQuery, poll.Chat.GMID, poll.Chat.Receiver, poll.PollID)
+	if err != nil || rows == nil {
+		return nil
+	}
+	defer rows.Close()
+	votes := make(map[groupme.ID]*PollVote)
+	for rows.Next() {
+		var vote PollVote
+		var answers string
+		err = rows.Scan(&vote.Voter, &answers, &vote.MXID)
+		if err != nil {
+			poll.log.Errorln("Database scan failed:", err)
+			continue
+		}
+		if len(answers) > 0 {
+			vote.Answers = strings.Split(answers, ",")
+		}
+		votes[vote.Voter] = &vote
+	}
+	return votes
+}
+
+func (poll *Poll) UpsertVote(vote *PollVote) {
+	_, err := poll.db.Exec(upsertPollVoteQuery, poll.Chat.GMID, poll.Chat.Receiver, poll.PollID, vote.Voter, strings.Join(vote.Answers, ","), vote.MXID)
+	if err != nil {
+		poll.log.Warnfln("Failed to upsert vote of %s in poll %s@%s: %v", vote.Voter, poll.Chat, poll.PollID, err)
+	}
+}
@@ -105,7 +105,7 @@ func (pq *PortalQuery) New() *Portal {
 }
 
 const (
-	portalColumns        = "gmid, receiver, mxid, name, name_set, topic, topic_set, avatar, avatar_url, avatar_set, encrypted"
+	portalColumns        = "gmid, receiver, mxid, name, name_set, topic, topic_set, avatar, avatar_url, avatar_set, encrypted, relay_user_id, like_icon_type, like_icon_pack_id, like_icon_pack_index"
 	getAllPortalsQuery   = "SELECT " + portalColumns + " FROM portal"
 	getPortalByGMIDQuery = getAllPortalsQuery + " WHERE gmid=$1 AND receiver=$2"
 	getPortalByMXIDQuery = getAllPortalsQuery + " WHERE mxid=$1"
@@ -168,12 +168,18 @@ type Portal struct {
 	AvatarURL id.ContentURI
 	AvatarSet bool
 	Encrypted bool
+
+	RelayUserID id.UserID
+
+	LikeIconType      string
+	LikeIconPackID    int
+	LikeIconPackIndex int
 }
 
 func (portal *Portal) Scan(row dbutil.Scannable) *Portal {
-	var mxid, avatarURL sql.NullString
+	var mxid, avatarURL, relayUserID sql.NullString
 
-	err := row.Scan(&portal.Key.GMID, &portal.Key.Receiver, &mxid, &portal.Name, &portal.NameSet, &portal.Topic, &portal.TopicSet, &portal.Avatar, &avatarURL, &portal.AvatarSet, &portal.Encrypted)
+	err := row.Scan(&portal.Key.GMID, &portal.Key.Receiver, &mxid, &portal.Name, &portal.NameSet, &portal.Topic, &portal.TopicSet, &portal.Avatar, &avatarURL, &portal.AvatarSet, &portal.Encrypted, &relayUserID, &portal.LikeIconType, &portal.LikeIconPackID, &portal.LikeIconPackIndex)
 	if err != nil {
 		if err != sql.ErrNoRows {
 			portal.log.Errorln("Database scan failed:", err)
@@ -182,6 +188,7 @@ func (portal *Portal) Scan(row dbutil.Scannable) *Portal {
 	}
 	portal.MXID = id.RoomID(mxid.String)
 	portal.AvatarURL, _ = id.ParseContentURI(avatarURL.String)
+	portal.RelayUserID = id.UserID(relayUserID.String)
 	return portal
 }
 
@@ -192,12 +199,20 @@ func (portal *Portal) mxidPtr() *id.RoomID {
 	return nil
 }
 
+func (portal *Portal) relayUserPtr() *id.UserID {
+	if len(portal.RelayUserID) > 0 {
+		return &portal.RelayUserID
+	}
+	return nil
+}
+
 func (portal *Portal) Insert() {
 	_, err := portal.db.Exec(fmt.Sprintf(`
 		INSERT INTO portal (%s)
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15)
 	`, portalColumns),
-		portal.Key.GMID, portal.Key.Receiver, portal.mxidPtr(), portal.Name, portal.NameSet, portal.Topic, portal.TopicSet, portal.Avatar, portal.AvatarURL.String(), portal.AvatarSet, portal.Encrypted)
+		portal.Key.GMID, portal.Key.Receiver, portal.mxidPtr(), portal.Name, portal.NameSet, portal.Topic, portal.TopicSet, portal.Avatar, portal.AvatarURL.String(), portal.AvatarSet, portal.Encrypted, portal.relayUserPtr(),
+		portal.LikeIconType, portal.LikeIconPackID, portal.LikeIconPackIndex)
 	if err != nil {
 		portal.log.Warnfln("Failed to insert %s: %v", portal.Key, err)
 	}
@@ -206,12 +221,14 @@ func (portal *Portal) Insert() {
 func (portal *Portal) Update(txn dbutil.Transaction) {
 	query := `
 		UPDATE portal
-		SET mxid=$1, name=$2, name_set=$3, topic=$4, topic_set=$5, avatar=$6, avatar_url=$7, avatar_set=$8, encrypted=$9
-		WHERE gmid=$10 AND receiver=$11
+		SET mxid=$1, name=$2, name_set=$3, topic=$4, topic_set=$5, avatar=$6, avatar_url=$7, avatar_set=$8, encrypted=$9, relay_user_id=$10,
+			like_icon_type=$11, like_icon_pack_id=$12, like_icon_pack_index=$13
+		WHERE gmid=$14 AND receiver=$15
 	`
 	args := []interface{}{
 		portal.mxidPtr(), portal.Name, portal.NameSet, portal.Topic, portal.TopicSet, portal.Avatar, portal.AvatarURL.String(),
-		portal.AvatarSet, portal.Encrypted, portal.Key.GMID, portal.Key.Receiver,
+		portal.AvatarSet, portal.Encrypted, portal.relayUserPtr(), portal.LikeIconType, portal.LikeIconPackID, portal.LikeIconPackIndex,
+		portal.Key.GMID, portal.Key.Receiver,
 	}
 	var err error
 	if txn != nil {
@@ -25,19 +25,28 @@ func (mq *ReactionQuery) New() *Reaction {
 
 const (
 	getReactionByTargetGMIDQuery = `
-		SELECT chat_gmid, chat_receiver, target_gmid, sender, mxid, gmid
+		SELECT chat_gmid, chat_receiver, target_gmid, target_part, sender, mxid, gmid, emoji
 		FROM reaction
 		WHERE chat_gmid=$1 AND chat_receiver=$2 AND target_gmid=$3 AND sender=$4
 	`
+	getAllReactionsByTargetGMIDQuery = `
+		SELECT chat_gmid, chat_receiver, target_gmid, target_part, sender, mxid, gmid, emoji
+		FROM reaction
+		WHERE chat_gmid=$1 AND chat_receiver=$2 AND target_gmid=$3
+	`
 	getReactionByMXIDQuery = `
-		SELECT chat_gmid, chat_receiver, target_gmid, sender, mxid, gmid FROM reaction
+		SELECT chat_gmid, chat_receiver, target_gmid, target_part, sender, mxid, gmid, emoji FROM reaction
+		WHERE mxid=$1
+	`
+	getAllReactionsByMXIDQuery = `
+		SELECT chat_gmid, chat_receiver, target_gmid, target_part, sender, mxid, gmid, emoji FROM reaction
 		WHERE mxid=$1
 	`
 	upsertReactionQuery = `
-		INSERT INTO reaction (chat_gmid, chat_receiver, target_gmid, sender, mxid, gmid)
-		VALUES ($1, $2, $3, $4, $5, $6)
+		INSERT INTO reaction (chat_gmid, chat_receiver, target_gmid, target_part, sender, mxid, gmid, emoji)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
 		ON CONFLICT (chat_gmid, chat_receiver, target_gmid, sender)
-			DO UPDATE SET mxid=excluded.mxid, gmid=excluded.gmid
+			DO UPDATE SET target_part=excluded.target_part, mxid=excluded.mxid, gmid=excluded.gmid, emoji=excluded.emoji
 	`
 	deleteReactionQuery = `
 		DELETE FROM reaction WHERE chat_gmid=$1 AND chat_receiver=$2 AND target_gmid=$3 AND sender=$4 AND mxid=$5
@@ -48,10 +57,34 @@ func (rq *ReactionQuery) GetByTargetGMID(chat PortalKey, gmid groupme.ID, sender
 	return rq.maybeScan(rq.db.QueryRow(getReactionByTargetGMIDQuery, chat.GMID, chat.Receiver, gmid, sender))
 }
 
+// GetAllByTargetGMID returns the reactions of every user to a GroupMe message.
+func (rq *ReactionQuery) GetAllByTargetGMID(chat PortalKey, gmid groupme.ID) []*Reaction {
+	return rq.getAll(getAllReactionsByTargetGMIDQuery, chat.GMID, chat.Receiver, gmid)
+}
+
 func (rq *ReactionQuery) GetByMXID(mxid id.EventID) *Reaction {
 	return rq.maybeScan(rq.db.QueryRow(getReactionByMXIDQuery, mxid))
 }
 
+// GetAllByMXID returns the reactions to every part of a split message that a Matrix reaction was bridged to.
+func (rq *ReactionQuery) GetAllByMXID(mxid id.EventID) []*Reaction {
+	return rq.getAll(getAllReactionsByMXIDQuery, mxid)
+}
+
+func (rq *ReactionQuery) getAll(query string, args ...interface{}) (reactions []*Reaction) {
+	rows, err := rq.db.Query(query, args...)
+	if err != nil || rows == nil {
+		return nil
+	}
+	defer rows.Close()
+	for rows.Next() {
+		if reaction := rq.New().Scan(rows); reaction != nil {
+			reactions = append(reactions, reaction)
+		}
+	}
+	return
+}
+
 func (rq *ReactionQuery) maybeScan(row *sql.Row) *Reaction {
 	if row == nil {
 		return nil
@@ -65,13 +98,19 @@ type Reaction struct {
 
 	Chat       PortalKey
 	TargetGMID groupme.ID
+	// TargetPart is the part of the target message that the Matrix reaction
+	// is attached to.
+	TargetPart int
 	Sender     groupme.ID
 	MXID       id.EventID
 	GMID       groupme.ID
+	// Emoji is the reaction without variation selectors. It's empty for
+	// reactions that were bridged before it was stored.
+	Emoji string
 }
 
 func (reaction *Reaction) Scan(row dbutil.Scannable) *Reaction {
-	err := row.Scan(&reaction.Chat.GMID, &reaction.Chat.Receiver, &reaction.TargetGMID, &reaction.Sender, &reaction.MXID, &reaction.GMID)
+	err := row.Scan(&reaction.Chat.GMID, &reaction.Chat.Receiver, &reaction.TargetGMID, &reaction.TargetPart, &reaction.Sender, &reaction.MXID, &reaction.GMID, &reaction.Emoji)
 	if err != nil {
 		if !errors.Is(err, sql.ErrNoRows) {
 			reaction.log.Errorln("Database scan failed:", err)
@@ -85,7 +124,7 @@ func (reaction *Reaction) Upsert(txn dbutil.Execable) {
 	if txn == nil {
 		txn = reaction.db
 	}
-	_, err := txn.Exec(upsertReactionQuery, reaction.Chat.GMID, reaction.Chat.Receiver, reaction.TargetGMID, reaction.Sender, reaction.MXID, reaction.GMID)
+	_, err := txn.Exec(upsertReactionQuery, reaction.Chat.GMID, reaction.Chat.Receiver, reaction.TargetGMID, reaction.TargetPart, reaction.Sender, reaction.MXID, reaction.GMID, reaction.Emoji)
 	if err != nil {
 		reaction.log.Warnfln("Failed to upsert reaction to %s@%s by %s: %v", reaction.Chat, reaction.TargetGMID, reaction.Sender, err)
 	}
@@ -1,4 +1,4 @@
--- v0 -> v1: Latest revision
+-- v0 -> v12: Latest revision
 
 CREATE TABLE "user" (
     mxid TEXT PRIMARY KEY,
@@ -24,6 +24,12 @@ CREATE TABLE portal (
     avatar_set BOOLEAN NOT NULL DEFAULT false,
     encrypted  BOOLEAN NOT NULL DEFAULT false,
 
+    relay_user_id TEXT,
+
+    like_icon_type       TEXT    NOT NULL DEFAULT '',
+    like_icon_pack_id    INTEGER NOT NULL DEFAULT 0,
+    like_icon_pack_index INTEGER NOT NULL DEFAULT 0,
+
     PRIMARY KEY (gmid, receiver)
 );
 
@@ -47,29 +53,115 @@ CREATE TABLE message (
     chat_gmid     TEXT,
     chat_receiver TEXT,
     gmid          TEXT,
-    mxid          TEXT UNIQUE,
+    mxid          TEXT,
+    part          INTEGER NOT NULL DEFAULT 0,
     sender        TEXT,
     timestamp     BIGINT,
     sent          BOOLEAN,
+    source_guid   TEXT,
 
-    PRIMARY KEY (chat_gmid, chat_receiver, gmid),
+    PRIMARY KEY (chat_gmid, chat_receiver, gmid, part),
+    UNIQUE (mxid, part),
     FOREIGN KEY (chat_gmid, chat_receiver) REFERENCES portal(gmid, receiver) ON DELETE CASCADE
 );
 
+CREATE UNIQUE INDEX message_source_guid_idx ON message (chat_gmid, chat_receiver, source_guid);
+
 CREATE TABLE reaction (
     chat_gmid     TEXT,
     chat_receiver TEXT,
     target_gmid   TEXT,
+    target_part   INTEGER NOT NULL DEFAULT 0,
     sender        TEXT,
 
-    mxid TEXT NOT NULL,
-    gmid TEXT NOT NULL,
+    mxid  TEXT NOT NULL,
+    gmid  TEXT NOT NULL,
+    emoji TEXT NOT NULL DEFAULT '',
 
     PRIMARY KEY (chat_gmid, chat_receiver, target_gmid, sender),
-    FOREIGN KEY (chat_gmid, chat_receiver, target_gmid) REFERENCES message(chat_gmid, chat_receiver, gmid)
+    FOREIGN KEY (chat_gmid, chat_receiver, target_gmid, target_part) REFERENCES message(chat_gmid, chat_receiver, gmid, part)
+        ON DELETE CASCADE ON UPDATE CASCADE
+);
+
+CREATE TABLE outbox (
+    -- only: postgres
+    id BIGINT PRIMARY KEY GENERATED BY DEFAULT AS IDENTITY,
+    -- only: sqlite
+    id INTEGER PRIMARY KEY,
+
+    chat_gmid     TEXT   NOT NULL,
+    chat_receiver TEXT   NOT NULL,
+    mxid          TEXT   NOT NULL UNIQUE,
+    sender        TEXT   NOT NULL,
+    event         TEXT   NOT NULL,
+    attempts      INTEGER NOT NULL DEFAULT 0,
+    next_attempt  BIGINT NOT NULL,
+    last_error    TEXT,
+
+    FOREIGN KEY (chat_gmid, chat_receiver) REFERENCES portal(gmid, receiver) ON DELETE CASCADE
+);
+
+CREATE TABLE poll (
+    chat_gmid     TEXT,
+    chat_receiver TEXT,
+    poll_id       TEXT,
+    mxid          TEXT    NOT NULL UNIQUE,
+    owner         TEXT    NOT NULL,
+    ended         BOOLEAN NOT NULL DEFAULT false,
+    answer_ids    TEXT    NOT NULL DEFAULT '',
+
+    PRIMARY KEY (chat_gmid, chat_receiver, poll_id),
+    FOREIGN KEY (chat_gmid, chat_receiver) REFERENCES portal(gmid, receiver) ON DELETE CASCADE
+);
+
+CREATE TABLE poll_vote (
+    chat_gmid     TEXT,
+    chat_receiver TEXT,
+    poll_id       TEXT,
+    voter         TEXT,
+    answers       TEXT NOT NULL,
+    mxid          TEXT NOT NULL,
+
+    PRIMARY KEY (chat_gmid, chat_receiver, poll_id, voter),
+    FOREIGN KEY (chat_gmid, chat_receiver, poll_id) REFERENCES poll(chat_gmid, chat_receiver, poll_id)
         ON DELETE CASCADE ON UPDATE CASCADE
 );
 
+CREATE TABLE calendar_event (
+    chat_gmid     TEXT,
+    chat_receiver TEXT,
+    event_id      TEXT,
+    mxid          TEXT NOT NULL UNIQUE,
+    ics_mxid      TEXT NOT NULL DEFAULT '',
+    body          TEXT NOT NULL DEFAULT '',
+    ics           TEXT NOT NULL DEFAULT '',
+
+    PRIMARY KEY (chat_gmid, chat_receiver, event_id),
+    FOREIGN KEY (chat_gmid, chat_receiver) REFERENCES portal(gmid, receiver) ON DELETE CASCADE
+);
+
+CREATE TABLE calendar_rsvp (
+    chat_gmid     TEXT,
+    chat_receiver TEXT,
+    event_id      TEXT,
+    user_gmid     TEXT,
+    going         BOOLEAN NOT NULL,
+    mxid          TEXT    NOT NULL,
+
+    PRIMARY KEY (chat_gmid, chat_receiver, event_id, user_gmid),
+    FOREIGN KEY (chat_gmid, chat_receiver, event_id) REFERENCES calendar_event(chat_gmid, chat_receiver, event_id)
+        ON DELETE CASCADE ON UPDATE CASCADE
+);
+
+CREATE TABLE powerup_emoji (
+    pack_id    INTEGER,
+    pack_index INTEGER,
+    mxc        TEXT NOT NULL UNIQUE,
+    name       TEXT NOT NULL DEFAULT '',
+
+    PRIMARY KEY (pack_id, pack_index)
+);
+
 CREATE TABLE user_portal (
     user_mxid       TEXT,
     portal_gmid     TEXT,
@@ -0,0 +1,40 @@
+-- v1 -> v2: Allow splitting Matrix messages into multiple GroupMe messages
+-- transaction: off
+
+-- only: postgres until "end only"
+BEGIN;
+ALTER TABLE message ADD COLUMN part INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE message DROP CONSTRAINT message_mxid_key;
+ALTER TABLE message ADD CONSTRAINT message_mxid_part_key UNIQUE (mxid, part);
+COMMIT;
+-- end only postgres
+
+-- only: sqlite until "end only"
+PRAGMA foreign_keys = OFF;
+BEGIN;
+
+CREATE TABLE message_new (
+    chat_gmid     TEXT,
+    chat_receiver TEXT,
+    gmid          TEXT,
+    mxid          TEXT,
+    part          INTEGER NOT NULL DEFAULT 0,
+    sender        TEXT,
+    timestamp     BIGINT,
+    sent          BOOLEAN,
+
+    PRIMARY KEY (chat_gmid, chat_receiver, gmid),
+    UNIQUE (mxid, part),
+    FOREIGN KEY (chat_gmid, chat_receiver) REFERENCES portal(gmid, receiver) ON DELETE CASCADE
+);
+
+INSERT INTO message_new (chat_gmid, chat_receiver, gmid, mxid, sender, timestamp, sent)
+SELECT chat_gmid, chat_receiver, gmid, mxid, sender, timestamp, sent FROM message;
+
+DROP TABLE message;
+ALTER TABLE message_new RENAME TO message;
+
+PRAGMA foreign_key_check;
+COMMIT;
+PRAGMA foreign_keys = ON;
+-- end only sqlite
@@ -0,0 +1,3 @@
+-- v3 -> v4: Store the source GUID of messages sent from Matrix
+ALTER TABLE message ADD COLUMN source_guid TEXT;
+CREATE UNIQUE INDEX message_source_guid_idx ON message (chat_gmid, chat_receiver, source_guid);
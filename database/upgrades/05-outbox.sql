@@ -0,0 +1,18 @@
+-- v4 -> v5: Add outbox for messages waiting to be sent to GroupMe
+CREATE TABLE outbox (
+    -- only: postgres
+    id BIGINT PRIMARY KEY GENERATED BY DEFAULT AS IDENTITY,
+    -- only: sqlite
+    id INTEGER PRIMARY KEY,
+
+    chat_gmid     TEXT   NOT NULL,
+    chat_receiver TEXT   NOT NULL,
+    mxid          TEXT   NOT NULL UNIQUE,
+    sender        TEXT   NOT NULL,
+    event         TEXT   NOT NULL,
+    attempts      INTEGER NOT NULL DEFAULT 0,
+    next_attempt  BIGINT NOT NULL,
+    last_error    TEXT,
+
+    FOREIGN KEY (chat_gmid, chat_receiver) REFERENCES portal(gmid, receiver) ON DELETE CASCADE
+);
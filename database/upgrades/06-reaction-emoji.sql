@@ -0,0 +1,2 @@
+-- v5 -> v6: Store the emoji of reactions to detect changed GroupMe reactions
+ALTER TABLE reaction ADD COLUMN emoji TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,4 @@
+-- v6 -> v7: Store the custom like icon of groups
+ALTER TABLE portal ADD COLUMN like_icon_type TEXT NOT NULL DEFAULT '';
+ALTER TABLE portal ADD COLUMN like_icon_pack_id INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE portal ADD COLUMN like_icon_pack_index INTEGER NOT NULL DEFAULT 0;
@@ -0,0 +1,25 @@
+-- v7 -> v8: Store bridged polls and the votes in them
+CREATE TABLE poll (
+    chat_gmid     TEXT,
+    chat_receiver TEXT,
+    poll_id       TEXT,
+    mxid          TEXT    NOT NULL UNIQUE,
+    owner         TEXT    NOT NULL,
+    ended         BOOLEAN NOT NULL DEFAULT false,
+
+    PRIMARY KEY (chat_gmid, chat_receiver, poll_id),
+    FOREIGN KEY (chat_gmid, chat_receiver) REFERENCES portal(gmid, receiver) ON DELETE CASCADE
+);
+
+CREATE TABLE poll_vote (
+    chat_gmid     TEXT,
+    chat_receiver TEXT,
+    poll_id       TEXT,
+    voter         TEXT,
+    answers       TEXT NOT NULL,
+    mxid          TEXT NOT NULL,
+
+    PRIMARY KEY (chat_gmid, chat_receiver, poll_id, voter),
+    FOREIGN KEY (chat_gmid, chat_receiver, poll_id) REFERENCES poll(chat_gmid, chat_receiver, poll_id)
+        ON DELETE CASCADE ON UPDATE CASCADE
+);
@@ -0,0 +1,2 @@
+-- v8 -> v9: Store the GroupMe option IDs of polls created on Matrix
+ALTER TABLE poll ADD COLUMN answer_ids TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,26 @@
+-- v9 -> v10: Store bridged calendar events and RSVPs
+CREATE TABLE calendar_event (
+    chat_gmid     TEXT,
+    chat_receiver TEXT,
+    event_id      TEXT,
+    mxid          TEXT NOT NULL UNIQUE,
+    ics_mxid      TEXT NOT NULL DEFAULT '',
+    body          TEXT NOT NULL DEFAULT '',
+    ics           TEXT NOT NULL DEFAULT '',
+
+    PRIMARY KEY (chat_gmid, chat_receiver, event_id),
+    FOREIGN KEY (chat_gmid, chat_receiver) REFERENCES portal(gmid, receiver) ON DELETE CASCADE
+);
+
+CREATE TABLE calendar_rsvp (
+    chat_gmid     TEXT,
+    chat_receiver TEXT,
+    event_id      TEXT,
+    user_gmid     TEXT,
+    going         BOOLEAN NOT NULL,
+    mxid          TEXT    NOT NULL,
+
+    PRIMARY KEY (chat_gmid, chat_receiver, event_id, user_gmid),
+    FOREIGN KEY (chat_gmid, chat_receiver, event_id) REFERENCES calendar_event(chat_gmid, chat_receiver, event_id)
+        ON DELETE CASCADE ON UPDATE CASCADE
+);
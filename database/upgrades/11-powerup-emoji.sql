@@ -0,0 +1,9 @@
+-- v10 -> v11: Store uploaded GroupMe emoji powerups
+CREATE TABLE powerup_emoji (
+    pack_id    INTEGER,
+    pack_index INTEGER,
+    mxc        TEXT NOT NULL UNIQUE,
+    name       TEXT NOT NULL DEFAULT '',
+
+    PRIMARY KEY (pack_id, pack_index)
+);
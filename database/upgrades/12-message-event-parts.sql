@@ -0,0 +1,76 @@
+-- v11 -> v12: Store every Matrix event of a GroupMe message as a separate part
+-- transaction: off
+
+-- only: postgres until "end only"
+BEGIN;
+ALTER TABLE reaction ADD COLUMN target_part INTEGER NOT NULL DEFAULT 0;
+UPDATE reaction SET target_part=message.part FROM message
+    WHERE message.chat_gmid=reaction.chat_gmid AND message.chat_receiver=reaction.chat_receiver
+      AND message.gmid=reaction.target_gmid;
+ALTER TABLE reaction DROP CONSTRAINT reaction_chat_gmid_chat_receiver_target_gmid_fkey;
+ALTER TABLE message DROP CONSTRAINT message_pkey;
+ALTER TABLE message ADD PRIMARY KEY (chat_gmid, chat_receiver, gmid, part);
+ALTER TABLE reaction ADD CONSTRAINT reaction_chat_gmid_chat_receiver_target_gmid_target_part_fkey
+    FOREIGN KEY (chat_gmid, chat_receiver, target_gmid, target_part) REFERENCES message(chat_gmid, chat_receiver, gmid, part)
+    ON DELETE CASCADE ON UPDATE CASCADE;
+COMMIT;
+-- end only postgres
+
+-- only: sqlite until "end only"
+PRAGMA foreign_keys = OFF;
+BEGIN;
+
+CREATE TABLE message_new (
+    chat_gmid     TEXT,
+    chat_receiver TEXT,
+    gmid          TEXT,
+    mxid          TEXT,
+    part          INTEGER NOT NULL DEFAULT 0,
+    sender        TEXT,
+    timestamp     BIGINT,
+    sent          BOOLEAN,
+    source_guid   TEXT,
+
+    PRIMARY KEY (chat_gmid, chat_receiver, gmid, part),
+    UNIQUE (mxid, part),
+    FOREIGN KEY (chat_gmid, chat_receiver) REFERENCES portal(gmid, receiver) ON DELETE CASCADE
+);
+
+INSERT INTO message_new (chat_gmid, chat_receiver, gmid, mxid, part, sender, timestamp, sent, source_guid)
+SELECT chat_gmid, chat_receiver, gmid, mxid, part, sender, timestamp, sent, source_guid FROM message;
+
+DROP TABLE message;
+ALTER TABLE message_new RENAME TO message;
+CREATE UNIQUE INDEX message_source_guid_idx ON message (chat_gmid, chat_receiver, source_guid);
+
+CREATE TABLE reaction_new (
+    chat_gmid     TEXT,
+    chat_receiver TEXT,
+    target_gmid   TEXT,
+    target_part   INTEGER NOT NULL DEFAULT 0,
+    sender        TEXT,
+
+    mxid  TEXT NOT NULL,
+    gmid  TEXT NOT NULL,
+    emoji TEXT NOT NULL DEFAULT '',
+
+    PRIMARY KEY (chat_gmid, chat_receiver, target_gmid, sender),
+    FOREIGN KEY (chat_gmid, chat_receiver, target_gmid, target_part) REFERENCES message(chat_gmid, chat_receiver, gmid, part)
+        ON DELETE CASCADE ON UPDATE CASCADE
+);
+
+INSERT INTO reaction_new (chat_gmid, chat_receiver, target_gmid, target_part, sender, mxid, gmid, emoji)
+SELECT chat_gmid, chat_receiver, target_gmid,
+       COALESCE((SELECT part FROM message
+                 WHERE message.chat_gmid=reaction.chat_gmid AND message.chat_receiver=reaction.chat_receiver
+                   AND message.gmid=reaction.target_gmid), 0),
+       sender, mxid, gmid, emoji
+FROM reaction;
+
+DROP TABLE reaction;
+ALTER TABLE reaction_new RENAME TO reaction;
+
+PRAGMA foreign_key_check;
+COMMIT;
+PRAGMA foreign_keys = ON;
+-- end only sqlite
@@ -36,7 +36,11 @@ type UserQuery struct {
 }
 
 func (uq *UserQuery) New() *User {
-	return &User{db: uq.db, log: uq.log}
+	return &User{
+		db:           uq.db,
+		log:          uq.log,
+		inSpaceCache: make(map[PortalKey]bool),
+	}
 }
 
 const (
@@ -0,0 +1,344 @@
+// mautrix-groupme - A Matrix-GroupMe puppeting bridge.
+// Copyright (C) 2022 Sumner Evans, Karmanyaah Malhotra
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"html"
+	"image"
+	"image/png"
+	"regexp"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/beeper/groupme-lib"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/beeper/groupme/database"
+	"github.com/beeper/groupme/groupmeext"
+)
+
+// groupMeEmojiPlaceholder is the character that GroupMe clients put in the
+// message text in place of each powerup emoji.
+const groupMeEmojiPlaceholder = "\ufffd"
+
+// StateImagePack is the MSC2545 room image pack state event, which clients
+// use to offer custom emojis to the user.
+var StateImagePack = event.Type{Type: "im.ponies.room_emotes", Class: event.StateEventType}
+
+type ImagePackImage struct {
+	URL  id.ContentURIString `json:"url"`
+	Body string              `json:"body,omitempty"`
+}
+
+type ImagePackEventContent struct {
+	Images map[string]ImagePackImage `json:"images"`
+	Pack   struct {
+		DisplayName string   `json:"display_name,omitempty"`
+		Usage       []string `json:"usage,omitempty"`
+	} `json:"pack"`
+}
+
+var errUnknownEmojiPack = errors.New("unknown emoji pack")
+
+// powerupShortcode returns the shortcode that a powerup emoji is published
+// with in the room image packs.
+func powerupShortcode(packID, packIndex int) string {
+	return fmt.Sprintf("groupme_%d_%d", packID, packIndex)
+}
+
+func imagePackStateKey(packID int) string {
+	return fmt.Sprintf("groupme_%d", packID)
+}
+
+// getEmojiPack returns the metadata of an emoji powerup pack. The pack list is
+// only fetched once and then kept in memory.
+func (br *GMBridge) getEmojiPack(packID int) (*groupmeext.EmojiPack, error) {
+	br.emojiPacksLock.Lock()
+	defer br.emojiPacksLock.Unlock()
+	if br.emojiPacks == nil {
+		packs, err := groupmeext.GetEmojiPacks(context.TODO())
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch emoji packs: %w", err)
+		}
+		br.emojiPacks = make(map[int]*groupmeext.EmojiPack, len(packs))
+		for _, pack := range packs {
+			br.emojiPacks[pack.Meta.PackID] = pack
+		}
+	}
+	pack, ok := br.emojiPacks[packID]
+	if !ok {
+		return nil, fmt.Errorf("%w %d", errUnknownEmojiPack, packID)
+	}
+	return pack, nil
+}
+
+// queueEmojiPackUpload starts uploading the emojis of a pack in the
+// background, unless it's already being uploaded or was uploaded since the
+// bridge was started. Failed uploads are retried the next time the pack is
+// used.
+func (br *GMBridge) queueEmojiPackUpload(packID int) {
+	br.emojiUploadsLock.Lock()
+	defer br.emojiUploadsLock.Unlock()
+	if _, ok := br.emojiUploads[packID]; ok {
+		return
+	}
+	if br.emojiUploads == nil {
+		br.emojiUploads = make(map[int]bool)
+	}
+	br.emojiUploads[packID] = true
+	go func() {
+		err := br.uploadEmojiPack(packID)
+		br.emojiUploadsLock.Lock()
+		defer br.emojiUploadsLock.Unlock()
+		if err != nil {
+			br.Log.Warnfln("Failed to upload emoji pack %d: %v", packID, err)
+			delete(br.emojiUploads, packID)
+		} else {
+			br.emojiUploads[packID] = false
+		}
+	}()
+}
+
+// uploadEmojiPack cuts the emoji sheet of a pack into separate images and
+// uploads the ones that haven't been uploaded yet.
+func (br *GMBridge) uploadEmojiPack(packID int) error {
+	pack, err := br.getEmojiPack(packID)
+	if err != nil {
+		return err
+	}
+	uploaded := make(map[int]bool)
+	for _, emoji := range br.DB.Emoji.GetPack(packID) {
+		uploaded[emoji.PackIndex] = true
+	}
+
+	sheet := pack.GetLargestSheet()
+	if sheet == nil || sheet.Height <= 0 {
+		return fmt.Errorf("emoji pack %d has no usable sheet", packID)
+	}
+	data, _, err := groupmeext.DownloadImage(sheet.ImageURL, br.Log)
+	if err != nil {
+		return fmt.Errorf("failed to download emoji sheet: %w", err)
+	}
+	img, _, err := image.Decode(bytes.NewReader(*data))
+	if err != nil {
+		return fmt.Errorf("failed to decode emoji sheet: %w", err)
+	}
+	subImager, ok := img.(interface {
+		SubImage(r image.Rectangle) image.Image
+	})
+	if !ok {
+		return fmt.Errorf("unsupported emoji sheet image type %T", img)
+	}
+
+	bounds := img.Bounds()
+	count := bounds.Dy() / sheet.Height
+	for i := 0; i < count; i++ {
+		if uploaded[i] {
+			continue
+		}
+		top := bounds.Min.Y + i*sheet.Height
+		glyph := subImager.SubImage(image.Rect(bounds.Min.X, top, bounds.Min.X+sheet.Width, top+sheet.Height))
+		var buf bytes.Buffer
+		if err = png.Encode(&buf, glyph); err != nil {
+			return fmt.Errorf("failed to encode emoji %d: %w", i, err)
+		}
+		resp, err := br.Bot.UploadBytes(buf.Bytes(), "image/png")
+		if err != nil {
+			return fmt.Errorf("failed to upload emoji %d: %w", i, err)
+		}
+		emoji := br.DB.Emoji.New()
+		emoji.PackID = packID
+		emoji.PackIndex = i
+		emoji.MXC = resp.ContentURI.CUString()
+		if i < len(pack.Meta.Transliterations) {
+			emoji.Name = pack.Meta.Transliterations[i]
+		}
+		emoji.Insert()
+	}
+	br.Log.Debugfln("Uploaded emoji pack %d (%s)", packID, pack.Name)
+	return nil
+}
+
+// getPowerupEmoji returns the uploaded image of a powerup emoji and publishes
+// its pack in the portal. If the emoji hasn't been uploaded yet, its pack is
+// uploaded in the background and nil is returned, so that the shortcode is
+// used until the upload is done.
+func (portal *Portal) getPowerupEmoji(packID, packIndex int) *database.PowerupEmoji {
+	emoji := portal.bridge.DB.Emoji.GetByIndex(packID, packIndex)
+	if emoji == nil {
+		portal.bridge.queueEmojiPackUpload(packID)
+		return nil
+	}
+	portal.publishEmojiPack(packID)
+	return emoji
+}
+
+// publishEmojiPack adds the uploaded emojis of a pack to the portal room as an
+// MSC2545 image pack, so that Matrix users can send them back.
+func (portal *Portal) publishEmojiPack(packID int) {
+	if portal.publishedEmojiPacks[packID] || len(portal.MXID) == 0 {
+		return
+	}
+	emojis := portal.bridge.DB.Emoji.GetPack(packID)
+	if len(emojis) == 0 {
+		return
+	}
+
+	content := &ImagePackEventContent{Images: make(map[string]ImagePackImage, len(emojis))}
+	for _, emoji := range emojis {
+		content.Images[powerupShortcode(emoji.PackID, emoji.PackIndex)] = ImagePackImage{
+			URL:  emoji.MXC,
+			Body: emoji.Name,
+		}
+	}
+	content.Pack.DisplayName = fmt.Sprintf("GroupMe pack %d", packID)
+	if pack, err := portal.bridge.getEmojiPack(packID); err == nil && len(pack.Name) > 0 {
+		content.Pack.DisplayName = pack.Name
+	}
+	content.Pack.Usage = []string{"emoticon"}
+
+	stateKey := imagePackStateKey(packID)
+	var existing ImagePackEventContent
+	err := portal.MainIntent().StateEvent(portal.MXID, StateImagePack, stateKey, &existing)
+	if err != nil || len(existing.Images) != len(content.Images) {
+		_, err = portal.MainIntent().SendStateEvent(portal.MXID, StateImagePack, stateKey, content)
+		if err != nil {
+			portal.log.Warnfln("Failed to publish emoji pack %d: %v", packID, err)
+			return
+		}
+	}
+	if portal.publishedEmojiPacks == nil {
+		portal.publishedEmojiPacks = make(map[int]bool)
+	}
+	portal.publishedEmojiPacks[packID] = true
+}
+
+// powerupEmojiRenderer replaces the placeholders of a GroupMe emoji attachment
+// in the message text, in the order of the attachment's charmap.
+type powerupEmojiRenderer struct {
+	placeholder string
+	charmap     [][]int
+	emojis      []*database.PowerupEmoji
+	htmlIndex   int
+}
+
+func (portal *Portal) newPowerupEmojiRenderer(attachment *groupme.Attachment) *powerupEmojiRenderer {
+	if attachment == nil || len(attachment.Charmap) == 0 {
+		return nil
+	}
+	renderer := &powerupEmojiRenderer{
+		placeholder: attachment.Placeholder,
+		charmap:     attachment.Charmap,
+		emojis:      make([]*database.PowerupEmoji, len(attachment.Charmap)),
+	}
+	if len(renderer.placeholder) == 0 {
+		renderer.placeholder = groupMeEmojiPlaceholder
+	}
+	for i, entry := range attachment.Charmap {
+		if len(entry) == 2 {
+			renderer.emojis[i] = portal.getPowerupEmoji(entry[0], entry[1])
+		}
+	}
+	return renderer
+}
+
+func (r *powerupEmojiRenderer) shortcode(i int) string {
+	if i >= len(r.charmap) || len(r.charmap[i]) != 2 {
+		return r.placeholder
+	}
+	return ":" + powerupShortcode(r.charmap[i][0], r.charmap[i][1]) + ":"
+}
+
+func (r *powerupEmojiRenderer) replacePlain(text string) string {
+	var out strings.Builder
+	for i, part := range strings.Split(text, r.placeholder) {
+		if i > 0 {
+			out.WriteString(r.shortcode(i - 1))
+		}
+		out.WriteString(part)
+	}
+	return out.String()
+}
+
+// escapeHTML is escapeGroupMeText with the placeholders replaced with inline
+// images. It must be called on consecutive segments of the text.
+func (r *powerupEmojiRenderer) escapeHTML(text []uint16) string {
+	var out strings.Builder
+	for i, part := range strings.Split(string(utf16.Decode(text)), r.placeholder) {
+		if i > 0 {
+			out.WriteString(r.imageTag(r.htmlIndex))
+			r.htmlIndex++
+		}
+		out.WriteString(strings.ReplaceAll(html.EscapeString(part), "\n", "<br/>"))
+	}
+	return out.String()
+}
+
+func (r *powerupEmojiRenderer) imageTag(i int) string {
+	shortcode := html.EscapeString(r.shortcode(i))
+	if i >= len(r.emojis) || r.emojis[i] == nil {
+		return shortcode
+	}
+	emoji := r.emojis[i]
+	title := shortcode
+	if len(emoji.Name) > 0 {
+		title = html.EscapeString(emoji.Name)
+	}
+	return fmt.Sprintf(`<img data-mx-emoticon src="%s" alt="%s" title="%s" height="32"/>`, html.EscapeString(string(emoji.MXC)), shortcode, title)
+}
+
+var (
+	htmlImageTagRegex       = regexp.MustCompile(`(?i)<img(\s[^>]*)?>`)
+	htmlImageAttributeRegex = regexp.MustCompile(`(?i)([a-z-]+)(?:\s*=\s*(?:"([^"]*)"|'([^']*)'|([^\s"'=<>` + "`" + `]+)))?`)
+)
+
+func parseImageAttributes(tag string) map[string]string {
+	attrs := make(map[string]string)
+	for _, match := range htmlImageAttributeRegex.FindAllStringSubmatch(strings.TrimPrefix(tag, "<img"), -1) {
+		attrs[strings.ToLower(match[1])] = html.UnescapeString(match[2] + match[3] + match[4])
+	}
+	return attrs
+}
+
+// replaceMatrixEmoticons replaces the custom emojis in the HTML of a Matrix
+// message. Bridged powerup emojis become GroupMe placeholders, which are
+// returned as an emoji attachment charmap, and others become their alt text.
+func (portal *Portal) replaceMatrixEmoticons(formatted string) (string, [][]int) {
+	if !strings.Contains(formatted, "data-mx-emoticon") {
+		return formatted, nil
+	}
+	var charmap [][]int
+	formatted = strings.ReplaceAll(formatted, groupMeEmojiPlaceholder, "")
+	formatted = htmlImageTagRegex.ReplaceAllStringFunc(formatted, func(tag string) string {
+		attrs := parseImageAttributes(tag)
+		if _, ok := attrs["data-mx-emoticon"]; !ok {
+			return tag
+		}
+		if emoji := portal.bridge.DB.Emoji.GetByMXC(id.ContentURIString(attrs["src"])); emoji != nil {
+			charmap = append(charmap, []int{emoji.PackID, emoji.PackIndex})
+			return groupMeEmojiPlaceholder
+		}
+		return html.EscapeString(attrs["alt"])
+	})
+	return formatted, charmap
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/beeper/groupme-lib"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/beeper/groupme/database"
+	"github.com/beeper/groupme/groupmeext"
+)
+
+const (
+	testSmileMXC = "mxc://example.com/smile"
+	testWinkMXC  = "mxc://example.com/wink"
+)
+
+// newTestEmojiPortal returns a portal whose bridge has emojis 1/0 (named
+// ":smile:") and 1/1 (unnamed) uploaded. Pack 2 is marked as uploaded, so that
+// its missing emojis don't start an upload.
+func newTestEmojiPortal(t *testing.T) (*Portal, *User) {
+	br, user := newTestUser(t)
+	for i, mxc := range []id.ContentURIString{testSmileMXC, testWinkMXC} {
+		emoji := br.DB.Emoji.New()
+		emoji.PackID = 1
+		emoji.PackIndex = i
+		emoji.MXC = mxc
+		if i == 0 {
+			emoji.Name = ":smile:"
+		}
+		emoji.Insert()
+	}
+	br.emojiUploads = map[int]bool{2: false}
+	portal := &Portal{Portal: br.DB.Portal.New(), bridge: br, log: br.Log}
+	portal.Key = database.GroupPortalKey("1")
+	return portal, user
+}
+
+func emoticonTag(mxc, alt string) string {
+	return fmt.Sprintf(`<img data-mx-emoticon src="%s" alt="%s" height="32"/>`, mxc, alt)
+}
+
+func TestParseImageAttributes(t *testing.T) {
+	tests := []struct {
+		name     string
+		tag      string
+		expected map[string]string
+	}{
+		{"double quotes", `<img src="mxc://a/b" alt="x">`, map[string]string{"src": "mxc://a/b", "alt": "x"}},
+		{"single quotes", `<img src='mxc://a/b' alt='it"s'>`, map[string]string{"src": "mxc://a/b", "alt": `it"s`}},
+		{"unquoted", `<img src=mxc://a/b alt=x>`, map[string]string{"src": "mxc://a/b", "alt": "x"}},
+		{"unquoted self-closing", `<img alt=x src=mxc://a/b />`, map[string]string{"src": "mxc://a/b", "alt": "x"}},
+		{"boolean", `<img data-mx-emoticon src="mxc://a/b">`, map[string]string{"data-mx-emoticon": "", "src": "mxc://a/b"}},
+		{"case and spaces", `<img SRC = "mxc://a/b" Alt="x" />`, map[string]string{"src": "mxc://a/b", "alt": "x"}},
+		{"entities", `<img alt="a &amp; b &lt;3">`, map[string]string{"alt": "a & b <3"}},
+		{"empty", `<img>`, map[string]string{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if attrs := parseImageAttributes(test.tag); !reflect.DeepEqual(attrs, test.expected) {
+				t.Errorf("expected %v, got %v", test.expected, attrs)
+			}
+		})
+	}
+}
+
+func TestReplaceMatrixEmoticons(t *testing.T) {
+	portal, _ := newTestEmojiPortal(t)
+	smile := emoticonTag(testSmileMXC, ":smile:")
+	wink := emoticonTag(testWinkMXC, ":wink:")
+
+	tests := []struct {
+		name     string
+		html     string
+		expected string
+		charmap  [][]int
+	}{
+		{"no emoticons", "<b>hi</b> " + groupMeEmojiPlaceholder, "<b>hi</b> " + groupMeEmojiPlaceholder, nil},
+		{"bridged", "hi " + smile + " there", "hi " + groupMeEmojiPlaceholder + " there", [][]int{{1, 0}}},
+		{"in order", wink + smile + wink, strings.Repeat(groupMeEmojiPlaceholder, 3), [][]int{{1, 1}, {1, 0}, {1, 1}}},
+		{"unknown emoticon", "a " + emoticonTag("mxc://example.com/other", "<3"), "a &lt;3", nil},
+		{"other images kept", `<img src="mxc://example.com/cat" alt="cat"> ` + smile, `<img src="mxc://example.com/cat" alt="cat"> ` + groupMeEmojiPlaceholder, [][]int{{1, 0}}},
+		{"literal placeholders removed", "a" + groupMeEmojiPlaceholder + "b " + smile, "ab " + groupMeEmojiPlaceholder, [][]int{{1, 0}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			formatted, charmap := portal.replaceMatrixEmoticons(test.html)
+			if formatted != test.expected {
+				t.Errorf("expected %q, got %q", test.expected, formatted)
+			}
+			if !reflect.DeepEqual(charmap, test.charmap) {
+				t.Errorf("expected charmap %v, got %v", test.charmap, charmap)
+			}
+		})
+	}
+}
+
+func TestPowerupEmojiRenderer(t *testing.T) {
+	portal, _ := newTestEmojiPortal(t)
+	bob := id.UserID("@groupme_2:example.com")
+	portal.bridge.puppets = map[groupme.ID]*Puppet{"2": {MXID: bob}}
+	p := groupMeEmojiPlaceholder
+	smile := `<img data-mx-emoticon src="mxc://example.com/smile" alt=":groupme_1_0:" title=":smile:" height="32"/>`
+	wink := `<img data-mx-emoticon src="mxc://example.com/wink" alt=":groupme_1_1:" title=":groupme_1_1:" height="32"/>`
+	pill := func(text string) string {
+		return fmt.Sprintf(`<a href="%s">%s</a>`, bob.URI().MatrixToURL(), text)
+	}
+	emojis := func(charmap ...[]int) *groupme.Attachment {
+		return &groupme.Attachment{Type: groupme.Emoji, Placeholder: p, Charmap: charmap}
+	}
+	mentions := func(loci ...[]int) *groupme.Attachment {
+		attachment := &groupme.Attachment{Type: groupme.Mentions, Loci: loci}
+		for range loci {
+			attachment.UserIDs = append(attachment.UserIDs, "2")
+		}
+		return attachment
+	}
+
+	tests := []struct {
+		name        string
+		text        string
+		attachments []*groupme.Attachment
+		body        string
+		formatted   string
+	}{
+		{"single", "hi " + p, []*groupme.Attachment{emojis([]int{1, 0})}, "hi :groupme_1_0:", "hi " + smile},
+		{"in order", p + p + " <" + p, []*groupme.Attachment{emojis([]int{1, 1}, []int{1, 0}, []int{1, 1})}, ":groupme_1_1::groupme_1_0: <:groupme_1_1:", wink + smile + " &lt;" + wink},
+		{"not uploaded", p, []*groupme.Attachment{emojis([]int{2, 5})}, ":groupme_2_5:", ":groupme_2_5:"},
+		{"invalid charmap entry", p + p, []*groupme.Attachment{emojis([]int{1}, []int{1, 0})}, p + ":groupme_1_0:", p + smile},
+		{"more placeholders than charmap", p + p, []*groupme.Attachment{emojis([]int{1, 0})}, ":groupme_1_0:" + p, smile + p},
+		{"custom placeholder", "a*b", []*groupme.Attachment{{Type: groupme.Emoji, Placeholder: "*", Charmap: [][]int{{1, 0}}}}, "a:groupme_1_0:b", "a" + smile + "b"},
+		{"mention after emoji", p + " @Bob " + p, []*groupme.Attachment{mentions([]int{2, 4}), emojis([]int{1, 0}, []int{1, 1})}, ":groupme_1_0: @Bob :groupme_1_1:", smile + " " + pill("@Bob") + " " + wink},
+		{"emoji inside mention", "@Bob" + p + " " + p, []*groupme.Attachment{emojis([]int{1, 0}, []int{1, 1}), mentions([]int{0, 5})}, "@Bob:groupme_1_0: :groupme_1_1:", pill("@Bob"+smile) + " " + wink},
+		{"unresolved mention", p + " @Bob", []*groupme.Attachment{emojis([]int{1, 0}), {Type: groupme.Mentions, Loci: [][]int{{2, 4}}, UserIDs: []groupme.ID{""}}}, ":groupme_1_0: @Bob", smile + " @Bob"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			content := portal.convertGroupMeText(&groupme.Message{Text: test.text, Attachments: test.attachments})
+			if content.Body != test.body {
+				t.Errorf("expected body %q, got %q", test.body, content.Body)
+			}
+			if content.Format != event.FormatHTML || content.FormattedBody != test.formatted {
+				t.Errorf("expected formatted body %q, got %q", test.formatted, content.FormattedBody)
+			}
+		})
+	}
+}
+
+func TestConvertMatrixMessageEmojiCharmap(t *testing.T) {
+	portal, user := newTestEmojiPortal(t)
+	user.Client = groupmeext.NewClient("token", user.log)
+	p := groupMeEmojiPlaceholder
+	smile := emoticonTag(testSmileMXC, ":smile:")
+	wink := emoticonTag(testWinkMXC, ":wink:")
+	a := func(n int) string {
+		return strings.Repeat("a", n)
+	}
+
+	tests := []struct {
+		name     string
+		html     string
+		texts    []string
+		charmaps [][][]int
+	}{
+		{"no emojis", "<b>hi</b>", []string{"*hi*"}, [][][]int{nil}},
+		{"single part", "hi " + smile + wink, []string{"hi " + p + p}, [][][]int{{{1, 0}, {1, 1}}}},
+		{
+			"split",
+			a(10) + " " + smile + " " + a(990) + " " + wink + smile,
+			[]string{a(10) + " " + p, a(990) + " " + p + p},
+			[][][]int{{{1, 0}}, {{1, 1}, {1, 0}}},
+		},
+		{
+			"only second part",
+			a(995) + " " + a(10) + " " + wink,
+			[]string{a(995), a(10) + " " + p},
+			[][][]int{nil, {{1, 1}}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			evt := &event.Event{
+				ID:   "$event",
+				Type: event.EventMessage,
+				Content: event.Content{Parsed: &event.MessageEventContent{
+					MsgType:       event.MsgText,
+					Format:        event.FormatHTML,
+					FormattedBody: test.html,
+				}},
+			}
+			parts, _, err := portal.convertMatrixMessage(user, evt)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(parts) != len(test.texts) {
+				t.Fatalf("expected %d parts, got %d", len(test.texts), len(parts))
+			}
+			for i, part := range parts {
+				if part.Text != test.texts[i] {
+					t.Errorf("expected text of part %d to be %q, got %q", i, test.texts[i], part.Text)
+				}
+				var charmap [][]int
+				for _, attachment := range part.Attachments {
+					if attachment.Type == groupme.Emoji {
+						charmap = attachment.Charmap
+					}
+				}
+				if !reflect.DeepEqual(charmap, test.charmaps[i]) {
+					t.Errorf("expected charmap of part %d to be %v, got %v", i, test.charmaps[i], charmap)
+				}
+			}
+		})
+	}
+}
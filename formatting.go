@@ -18,33 +18,382 @@ package main
 
 import (
 	"fmt"
+	"html"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"github.com/beeper/groupme-lib"
 
 	"maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/format"
+	"maunium.net/go/mautrix/id"
 	"maunium.net/go/mautrix/util/variationselector"
+
+	"github.com/beeper/groupme/config"
 )
 
 const formatterContextAllowedMentionsKey = "com.beeper.groupme.allowed_mentions"
+const formatterContextMentionedUsersKey = "com.beeper.groupme.mentioned_users"
+
+// Mentions are wrapped in these markers while parsing, because the offsets
+// of the mention in the final text aren't known until the whole message has
+// been converted. The marker is followed by the index of the mentioned user.
+const (
+	mentionStartMarker = '\x02'
+	mentionEndMarker   = '\x03'
+)
 
 func (br *GMBridge) pillConverter(displayname, mxid, eventID string, ctx format.Context) string {
 	// GroupMe only supports user mentions.
 	if len(mxid) == 0 || mxid[0] != '@' {
 		return displayname
 	}
+	if allowed, ok := ctx.ReturnData[formatterContextAllowedMentionsKey].(map[id.UserID]bool); ok && !allowed[id.UserID(mxid)] {
+		return fmt.Sprintf("@%s", displayname)
+	}
+
+	var gmid groupme.ID
+	if puppetID, ok := br.ParsePuppetMXID(id.UserID(mxid)); ok {
+		gmid = puppetID
+	} else if user := br.GetUserByMXIDIfExists(id.UserID(mxid)); user != nil && len(user.GMID) > 0 {
+		gmid = user.GMID
+	}
+	mentioned, ok := ctx.ReturnData[formatterContextMentionedUsersKey].(*[]groupme.ID)
+	if len(gmid) == 0 || !ok {
+		return fmt.Sprintf("@%s", displayname)
+	}
+	*mentioned = append(*mentioned, gmid)
+	return fmt.Sprintf("%c%d%c@%s%c", mentionStartMarker, len(*mentioned)-1, mentionStartMarker, displayname, mentionEndMarker)
+}
+
+var matrixHTMLParser = newMatrixHTMLParser(&config.FormattingConfig{
+	Bold:             "*",
+	Italic:           "_",
+	Strikethrough:    "~",
+	Monospace:        "`",
+	FencedCodeBlocks: true,
+	LinkURLs:         true,
+})
+
+// newMatrixHTMLParser creates the HTML parser used to render Matrix messages
+// as GroupMe plain text. Lists, blockquotes and headers use the default
+// mautrix rendering, everything else follows the formatting config.
+func newMatrixHTMLParser(cfg *config.FormattingConfig) *format.HTMLParser {
+	surround := func(marker string) format.TextConverter {
+		return func(text string, _ format.Context) string {
+			if len(text) == 0 {
+				return text
+			}
+			return marker + text + marker
+		}
+	}
+	parser := &format.HTMLParser{
+		TabsToSpaces:           4,
+		Newline:                "\n",
+		HorizontalLine:         "\n---\n",
+		BoldConverter:          surround(cfg.Bold),
+		ItalicConverter:        surround(cfg.Italic),
+		StrikethroughConverter: surround(cfg.Strikethrough),
+		MonospaceConverter:     surround(cfg.Monospace),
+	}
+	if !cfg.FencedCodeBlocks {
+		parser.MonospaceBlockConverter = func(code, _ string, _ format.Context) string {
+			return strings.TrimSuffix(code, "\n")
+		}
+	}
+	if !cfg.LinkURLs {
+		parser.LinkConverter = func(text, _ string, _ format.Context) string {
+			return text
+		}
+	}
+	return parser
+}
+
+// parseMatrixHTML converts the body of a Matrix message into GroupMe text.
+// If the message mentions any GroupMe users, a mentions attachment is
+// returned along with the text.
+func (portal *Portal) parseMatrixHTML(content *event.MessageEventContent) (string, *groupme.Attachment) {
+	if content.Format != event.FormatHTML || len(content.FormattedBody) == 0 {
+		return variationselector.FullyQualify(content.Body), nil
+	}
+	ctx := format.NewContext()
+	if content.Mentions != nil {
+		allowedMentions := make(map[id.UserID]bool, len(content.Mentions.UserIDs))
+		for _, userID := range content.Mentions.UserIDs {
+			allowedMentions[userID] = true
+		}
+		ctx.ReturnData[formatterContextAllowedMentionsKey] = allowedMentions
+	}
+	var mentioned []groupme.ID
+	ctx.ReturnData[formatterContextMentionedUsersKey] = &mentioned
+	text := variationselector.FullyQualify(matrixHTMLParser.Parse(content.FormattedBody, ctx))
+	return extractMentions(text, mentioned)
+}
+
+// extractMentions removes the mention markers inserted by pillConverter and
+// builds a GroupMe mentions attachment out of them. GroupMe loci are
+// [start, length] pairs counted in UTF-16 code units.
+func extractMentions(text string, mentioned []groupme.ID) (string, *groupme.Attachment) {
+	if len(mentioned) == 0 {
+		return text, nil
+	}
+	attachment := &groupme.Attachment{Type: groupme.Mentions}
+	var out strings.Builder
+	offset := 0
+	mentionStart := -1
+	for i := 0; i < len(text); {
+		switch text[i] {
+		case mentionStartMarker:
+			end := strings.IndexByte(text[i+1:], mentionStartMarker)
+			if end < 0 {
+				i++
+				continue
+			}
+			index, err := strconv.Atoi(text[i+1 : i+1+end])
+			if err == nil && index < len(mentioned) {
+				attachment.UserIDs = append(attachment.UserIDs, mentioned[index])
+				mentionStart = offset
+			}
+			i += end + 2
+		case mentionEndMarker:
+			if mentionStart >= 0 {
+				attachment.Loci = append(attachment.Loci, []int{mentionStart, offset - mentionStart})
+				mentionStart = -1
+			}
+			i++
+		default:
+			r, size := utf8.DecodeRuneInString(text[i:])
+			out.WriteString(text[i : i+size])
+			offset += utf16Len(r)
+			i += size
+		}
+	}
+	if len(attachment.Loci) == 0 {
+		return out.String(), nil
+	}
+	return out.String(), attachment
+}
+
+// prefixText adds a prefix to text that has already been parsed, moving the
+// mentions in the text to match.
+func prefixText(prefix, text string, mentions *groupme.Attachment) string {
+	if mentions != nil {
+		shift := len(utf16.Encode([]rune(prefix)))
+		for _, locus := range mentions.Loci {
+			locus[0] += shift
+		}
+	}
+	return prefix + text
+}
+
+func utf16Len(r rune) int {
+	if r >= 0x10000 {
+		return 2
+	}
+	return 1
+}
+
+// maxMessageLength is the maximum length of a GroupMe message in UTF-16 code units.
+const maxMessageLength = 1000
+
+// splitMessageText splits text that is too long for a single GroupMe message
+// into several parts, preferring paragraph breaks, then line breaks, then
+// spaces. Mentions are never split, and are moved into the part they end up in.
+func splitMessageText(text string, mentions *groupme.Attachment) ([]string, []*groupme.Attachment) {
+	runes := []rune(text)
+	// offsets[i] is the UTF-16 offset of runes[i] in the text
+	offsets := make([]int, len(runes)+1)
+	for i, r := range runes {
+		offsets[i+1] = offsets[i] + utf16Len(r)
+	}
+	if offsets[len(runes)] <= maxMessageLength {
+		return []string{text}, []*groupme.Attachment{mentions}
+	}
 
-	return fmt.Sprintf("@%s", displayname)
+	var parts []string
+	var partMentions []*groupme.Attachment
+	for start := 0; start < len(runes); {
+		end := len(runes)
+		if offsets[end]-offsets[start] > maxMessageLength {
+			end = findSplitPoint(runes, offsets, start, mentions)
+		}
+		partRunes := []rune(strings.TrimRightFunc(string(runes[start:end]), unicode.IsSpace))
+		// Whitespace-only chunks are dropped rather than sent as empty messages.
+		if len(partRunes) > 0 {
+			parts = append(parts, string(partRunes))
+			partMentions = append(partMentions, sliceMentions(mentions, offsets[start], offsets[start+len(partRunes)]))
+		}
+		start = end
+		for start < len(runes) && unicode.IsSpace(runes[start]) {
+			start++
+		}
+	}
+	if len(parts) == 0 {
+		// The message may still have attachments, which go in the first part.
+		return []string{""}, []*groupme.Attachment{nil}
+	}
+	return parts, partMentions
 }
 
-var matrixHTMLParser = &format.HTMLParser{
-	TabsToSpaces:   4,
-	Newline:        "\n",
-	HorizontalLine: "\n---\n",
+func findSplitPoint(runes []rune, offsets []int, start int, mentions *groupme.Attachment) int {
+	limit := start
+	for limit < len(runes) && offsets[limit+1]-offsets[start] <= maxMessageLength {
+		limit++
+	}
+	insideMention := func(i int) bool {
+		if mentions == nil {
+			return false
+		}
+		for _, locus := range mentions.Loci {
+			if offsets[i] > locus[0] && offsets[i] < locus[0]+locus[1] {
+				return true
+			}
+		}
+		return false
+	}
+	at := func(i int) rune {
+		if i < 0 || i >= len(runes) {
+			return 0
+		}
+		return runes[i]
+	}
+	// A split point may also be right before a separator, as the whitespace
+	// around split points is trimmed from both parts.
+	separators := []func(i int) bool{
+		func(i int) bool {
+			return at(i-2) == '\n' && at(i-1) == '\n' || at(i-1) == '\n' && at(i) == '\n' || at(i) == '\n' && at(i+1) == '\n'
+		},
+		func(i int) bool { return at(i-1) == '\n' || at(i) == '\n' },
+		func(i int) bool { return unicode.IsSpace(at(i-1)) || unicode.IsSpace(at(i)) },
+	}
+	for _, isSeparator := range separators {
+		for i := limit; i > start; i-- {
+			if isSeparator(i) && !insideMention(i) {
+				return i
+			}
+		}
+	}
+	for i := limit; i > start; i-- {
+		if !insideMention(i) {
+			return i
+		}
+	}
+	return limit
+}
+
+func sliceMentions(mentions *groupme.Attachment, from, to int) *groupme.Attachment {
+	if mentions == nil {
+		return nil
+	}
+	sliced := &groupme.Attachment{Type: groupme.Mentions}
+	for i, locus := range mentions.Loci {
+		if locus[0] >= from && locus[0]+locus[1] <= to {
+			sliced.Loci = append(sliced.Loci, []int{locus[0] - from, locus[1]})
+			sliced.UserIDs = append(sliced.UserIDs, mentions.UserIDs[i])
+		}
+	}
+	if len(sliced.Loci) == 0 {
+		return nil
+	}
+	return sliced
 }
 
-func (portal *Portal) parseMatrixHTML(content *event.MessageEventContent) string {
-	if content.Format == event.FormatHTML && len(content.FormattedBody) > 0 {
-		return variationselector.FullyQualify(matrixHTMLParser.Parse(content.FormattedBody, format.NewContext()))
-	} else {
-		return variationselector.FullyQualify(content.Body)
+// convertGroupMeText converts the text of a GroupMe message into a Matrix
+// message. Mentions are rendered as pills to the mentioned users in the HTML
+// body, while the plain body is kept as-is.
+func (portal *Portal) convertGroupMeText(message *groupme.Message) *event.MessageEventContent {
+	content := &event.MessageEventContent{
+		Body:    message.Text,
+		MsgType: event.MsgText,
+	}
+	var mentions, emoji *groupme.Attachment
+	for _, attachment := range message.Attachments {
+		if attachment.Type == groupme.Mentions && mentions == nil {
+			mentions = attachment
+		} else if attachment.Type == groupme.Emoji && emoji == nil {
+			emoji = attachment
+		}
+	}
+	emojis := portal.newPowerupEmojiRenderer(emoji)
+	if emojis != nil {
+		content.Body = emojis.replacePlain(message.Text)
 	}
+	if emojis == nil && (mentions == nil || len(mentions.Loci) == 0) {
+		return content
+	}
+
+	escape := escapeGroupMeText
+	if emojis != nil {
+		escape = emojis.escapeHTML
+	}
+	text := utf16.Encode([]rune(message.Text))
+	var formatted strings.Builder
+	var mentioned []id.UserID
+	offset := 0
+	if mentions != nil {
+		for _, locus := range sortedMentionLoci(mentions) {
+			start, end := locus[0], locus[0]+locus[1]
+			if start < offset || end > len(text) || locus[1] <= 0 {
+				continue
+			}
+			mxid := portal.getMentionedMXID(mentions.UserIDs[locus[2]])
+			if len(mxid) == 0 {
+				continue
+			}
+			formatted.WriteString(escape(text[offset:start]))
+			_, _ = fmt.Fprintf(&formatted, `<a href="%s">%s</a>`, mxid.URI().MatrixToURL(), escape(text[start:end]))
+			mentioned = append(mentioned, mxid)
+			offset = end
+		}
+	}
+	if len(mentioned) == 0 && emojis == nil {
+		return content
+	}
+	formatted.WriteString(escape(text[offset:]))
+	content.Format = event.FormatHTML
+	content.FormattedBody = formatted.String()
+	if len(mentioned) > 0 {
+		content.Mentions = &event.Mentions{UserIDs: mentioned}
+	}
+	return content
+}
+
+// sortedMentionLoci returns the loci of a mentions attachment ordered by
+// their position in the text. The index of the mentioned user in UserIDs is
+// appended to each locus.
+func sortedMentionLoci(mentions *groupme.Attachment) [][3]int {
+	loci := make([][3]int, 0, len(mentions.Loci))
+	for i, locus := range mentions.Loci {
+		if len(locus) == 2 && i < len(mentions.UserIDs) {
+			loci = append(loci, [3]int{locus[0], locus[1], i})
+		}
+	}
+	sort.SliceStable(loci, func(i, j int) bool {
+		return loci[i][0] < loci[j][0]
+	})
+	return loci
+}
+
+// getMentionedMXID finds the Matrix user that a GroupMe mention should
+// highlight: the bridge user itself if they're logged in, and their puppet
+// otherwise.
+func (portal *Portal) getMentionedMXID(gmid groupme.ID) id.UserID {
+	if len(gmid) == 0 {
+		return ""
+	}
+	if user := portal.bridge.GetUserByGMID(gmid); user != nil {
+		return user.MXID
+	}
+	if puppet := portal.bridge.GetPuppetByGMID(gmid); puppet != nil {
+		return puppet.MXID
+	}
+	return ""
+}
+
+func escapeGroupMeText(text []uint16) string {
+	return strings.ReplaceAll(html.EscapeString(string(utf16.Decode(text))), "\n", "<br/>")
 }
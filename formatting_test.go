@@ -0,0 +1,301 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"unicode/utf16"
+
+	"github.com/beeper/groupme-lib"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/beeper/groupme/config"
+	"github.com/beeper/groupme/database"
+)
+
+func TestParseMatrixHTML(t *testing.T) {
+	portal := &Portal{}
+
+	tests := []struct {
+		name     string
+		body     string
+		html     string
+		expected string
+	}{
+		{"plain", "hello", "", "hello"},
+		{"bold", "**hi**", "<strong>hi</strong> there", "*hi* there"},
+		{"italic", "_hi_", "<em>hi</em>", "_hi_"},
+		{"strikethrough", "~~hi~~", "<del>hi</del>", "~hi~"},
+		{"nested", "", "<b><i>hi</i></b>", "*_hi_*"},
+		{"inline code", "", "run <code>make</code> now", "run `make` now"},
+		{"code block", "", "<pre><code class=\"language-go\">fmt.Println()\n</code></pre>", "```go\nfmt.Println()\n```"},
+		{"blockquote", "", "<blockquote><p>first</p><p>second</p></blockquote><p>reply</p>", "> first\n> \n> second\n\nreply"},
+		{"ordered list", "", "<ol><li>one</li><li>two</li></ol>", "1. one\n2. two"},
+		{"ordered list start", "", "<ol start=\"9\"><li>nine</li><li>ten</li></ol>", "9.  nine\n10. ten"},
+		{"unordered list", "", "<ul><li>a</li><li>b</li></ul>", "* a\n* b"},
+		{"link", "", "<a href=\"https://example.com\">example</a>", "example (https://example.com)"},
+		{"bare link", "", "<a href=\"https://example.com\">https://example.com</a>", "https://example.com"},
+		{"line breaks", "", "a<br>b", "a\nb"},
+		{"empty bold", "", "a<b></b>b", "ab"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			content := &event.MessageEventContent{MsgType: event.MsgText, Body: test.body}
+			if len(test.html) > 0 {
+				content.Format = event.FormatHTML
+				content.FormattedBody = test.html
+			}
+			text, mentions := portal.parseMatrixHTML(content)
+			if text != test.expected {
+				t.Errorf("expected %q, got %q", test.expected, text)
+			}
+			if mentions != nil {
+				t.Errorf("expected no mentions, got %+v", mentions)
+			}
+		})
+	}
+}
+
+func TestParseMatrixHTMLCustomFormatting(t *testing.T) {
+	defaultParser := matrixHTMLParser
+	defer func() {
+		matrixHTMLParser = defaultParser
+	}()
+	matrixHTMLParser = newMatrixHTMLParser(&config.FormattingConfig{
+		Bold:      "**",
+		Monospace: "'",
+	})
+	portal := &Portal{}
+
+	tests := []struct {
+		name     string
+		html     string
+		expected string
+	}{
+		{"bold", "<b>hi</b>", "**hi**"},
+		{"italic dropped", "<i>hi</i>", "hi"},
+		{"strikethrough dropped", "<s>hi</s>", "hi"},
+		{"inline code", "<code>x</code>", "'x'"},
+		{"unfenced code block", "<pre><code>line 1\nline 2\n</code></pre>", "line 1\nline 2"},
+		{"link without url", "<a href=\"https://example.com\">example</a>", "example"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			text, _ := portal.parseMatrixHTML(&event.MessageEventContent{
+				MsgType:       event.MsgText,
+				Format:        event.FormatHTML,
+				FormattedBody: test.html,
+			})
+			if text != test.expected {
+				t.Errorf("expected %q, got %q", test.expected, text)
+			}
+		})
+	}
+}
+
+func TestSplitMessageText(t *testing.T) {
+	mention := func(loci ...[]int) *groupme.Attachment {
+		attachment := &groupme.Attachment{Type: groupme.Mentions}
+		for i, locus := range loci {
+			attachment.Loci = append(attachment.Loci, locus)
+			attachment.UserIDs = append(attachment.UserIDs, groupme.ID(strconv.Itoa(i+1)))
+		}
+		return attachment
+	}
+	a := func(n int) string {
+		return strings.Repeat("a", n)
+	}
+
+	tests := []struct {
+		name             string
+		text             string
+		mentions         *groupme.Attachment
+		expected         []string
+		expectedMentions []*groupme.Attachment
+	}{
+		{
+			name:             "short",
+			text:             "hello",
+			expected:         []string{"hello"},
+			expectedMentions: []*groupme.Attachment{nil},
+		},
+		{
+			name:             "exact limit",
+			text:             a(1000),
+			expected:         []string{a(1000)},
+			expectedMentions: []*groupme.Attachment{nil},
+		},
+		{
+			name:             "paragraph break preferred",
+			text:             a(400) + "\n\n" + a(300) + "\n" + a(200) + " " + a(200),
+			expected:         []string{a(400), a(300) + "\n" + a(200) + " " + a(200)},
+			expectedMentions: []*groupme.Attachment{nil, nil},
+		},
+		{
+			name:             "line break preferred over space",
+			text:             a(400) + " " + a(400) + "\n" + a(400),
+			expected:         []string{a(400) + " " + a(400), a(400)},
+			expectedMentions: []*groupme.Attachment{nil, nil},
+		},
+		{
+			name:             "no separators",
+			text:             a(1500),
+			expected:         []string{a(1000), a(500)},
+			expectedMentions: []*groupme.Attachment{nil, nil},
+		},
+		{
+			// The emoji is two UTF-16 code units, so it doesn't fit in the first part.
+			name:             "astral character at boundary",
+			text:             a(999) + "\U0001f600" + a(10),
+			expected:         []string{a(999), "\U0001f600" + a(10)},
+			expectedMentions: []*groupme.Attachment{nil, nil},
+		},
+		{
+			name:             "astral characters count twice",
+			text:             strings.Repeat("\U0001f600", 501),
+			expected:         []string{strings.Repeat("\U0001f600", 500), "\U0001f600"},
+			expectedMentions: []*groupme.Attachment{nil, nil},
+		},
+		{
+			name:             "mention after astral character moved to second part",
+			text:             "\U0001f600 " + a(990) + " @Alice Smith " + a(100),
+			mentions:         mention([]int{994, 12}),
+			expected:         []string{"\U0001f600 " + a(990), "@Alice Smith " + a(100)},
+			expectedMentions: []*groupme.Attachment{nil, mention([]int{0, 12})},
+		},
+		{
+			name:             "mention across boundary is not split",
+			text:             a(990) + " @Alice Smith " + a(100),
+			mentions:         mention([]int{991, 12}),
+			expected:         []string{a(990), "@Alice Smith " + a(100)},
+			expectedMentions: []*groupme.Attachment{nil, mention([]int{0, 12})},
+		},
+		{
+			name:             "mentions in both parts",
+			text:             "@Bob " + a(995) + " @Alice",
+			mentions:         mention([]int{0, 4}, []int{1001, 6}),
+			expected:         []string{"@Bob " + a(995), "@Alice"},
+			expectedMentions: []*groupme.Attachment{mention([]int{0, 4}), {Type: groupme.Mentions, Loci: [][]int{{0, 6}}, UserIDs: []groupme.ID{"2"}}},
+		},
+		{
+			name:             "whitespace head",
+			text:             strings.Repeat(" ", 1200) + a(10),
+			expected:         []string{a(10)},
+			expectedMentions: []*groupme.Attachment{nil},
+		},
+		{
+			name:             "space right after limit",
+			text:             a(1000) + " " + a(10),
+			expected:         []string{a(1000), a(10)},
+			expectedMentions: []*groupme.Attachment{nil, nil},
+		},
+		{
+			name:             "whitespace only",
+			text:             strings.Repeat(" ", 1200),
+			expected:         []string{""},
+			expectedMentions: []*groupme.Attachment{nil},
+		},
+		{
+			name:             "whitespace between parts",
+			text:             a(1000) + strings.Repeat("\n", 1500) + a(10),
+			expected:         []string{a(1000), a(10)},
+			expectedMentions: []*groupme.Attachment{nil, nil},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			parts, partMentions := splitMessageText(test.text, test.mentions)
+			if !reflect.DeepEqual(parts, test.expected) {
+				t.Errorf("expected parts with lengths %v, got %v", partLengths(test.expected), partLengths(parts))
+			}
+			if !reflect.DeepEqual(partMentions, test.expectedMentions) {
+				t.Errorf("expected mentions %s, got %s", describeMentions(test.expectedMentions), describeMentions(partMentions))
+			}
+		})
+	}
+}
+
+func partLengths(parts []string) []int {
+	lengths := make([]int, len(parts))
+	for i, part := range parts {
+		lengths[i] = len(utf16.Encode([]rune(part)))
+	}
+	return lengths
+}
+
+func describeMentions(mentions []*groupme.Attachment) string {
+	descriptions := make([]string, len(mentions))
+	for i, attachment := range mentions {
+		if attachment == nil {
+			descriptions[i] = "nil"
+		} else {
+			descriptions[i] = fmt.Sprintf("%v%v", attachment.Loci, attachment.UserIDs)
+		}
+	}
+	return "[" + strings.Join(descriptions, " ") + "]"
+}
+
+func TestConvertGroupMeText(t *testing.T) {
+	alice := id.UserID("@alice:example.com")
+	bob := id.UserID("@groupme_2:example.com")
+	br, _ := newTestUser(t)
+	br.usersByGMID = map[groupme.ID]*User{"1": {User: &database.User{MXID: alice}}}
+	br.puppets = map[groupme.ID]*Puppet{"2": {MXID: bob}}
+	portal := &Portal{bridge: br}
+	pill := func(mxid id.UserID, text string) string {
+		return fmt.Sprintf(`<a href="%s">%s</a>`, mxid.URI().MatrixToURL(), text)
+	}
+	mentions := func(loci [][]int, userIDs ...groupme.ID) *groupme.Attachment {
+		return &groupme.Attachment{Type: groupme.Mentions, Loci: loci, UserIDs: userIDs}
+	}
+
+	tests := []struct {
+		name      string
+		text      string
+		mentions  *groupme.Attachment
+		formatted string
+		mentioned []id.UserID
+	}{
+		{"plain", "hello <world>", nil, "", nil},
+		{"no loci", "hello", mentions(nil), "", nil},
+		{"user", "hi @Alice!", mentions([][]int{{3, 6}}, "1"), "hi " + pill(alice, "@Alice") + "!", []id.UserID{alice}},
+		{"puppet", "@Bob hi", mentions([][]int{{0, 4}}, "2"), pill(bob, "@Bob") + " hi", []id.UserID{bob}},
+		{"astral before", "😀😀 @Bob", mentions([][]int{{5, 4}}, "2"), "😀😀 " + pill(bob, "@Bob"), []id.UserID{bob}},
+		{"astral inside", "@B😀b hi", mentions([][]int{{0, 5}}, "2"), pill(bob, "@B😀b") + " hi", []id.UserID{bob}},
+		{"unsorted loci", "@Bob @Alice", mentions([][]int{{5, 6}, {0, 4}}, "1", "2"), pill(bob, "@Bob") + " " + pill(alice, "@Alice"), []id.UserID{bob, alice}},
+		{"overlapping loci", "@Alice", mentions([][]int{{0, 6}, {1, 5}}, "1", "2"), pill(alice, "@Alice"), []id.UserID{alice}},
+		{"out of range", "@Bob", mentions([][]int{{2, 4}}, "2"), "", nil},
+		{"empty locus", "@Bob", mentions([][]int{{0, 0}}, "2"), "", nil},
+		{"missing user id", "@Bob @Alice", mentions([][]int{{0, 4}, {5, 6}}, "2"), pill(bob, "@Bob") + " @Alice", []id.UserID{bob}},
+		{"empty user id", "@Bob", mentions([][]int{{0, 4}}, ""), "", nil},
+		{"escaped", "a < b\n@Bob & co", mentions([][]int{{6, 4}}, "2"), "a &lt; b<br/>" + pill(bob, "@Bob") + " &amp; co", []id.UserID{bob}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			message := &groupme.Message{Text: test.text}
+			if test.mentions != nil {
+				message.Attachments = []*groupme.Attachment{test.mentions}
+			}
+			content := portal.convertGroupMeText(message)
+			if content.Body != test.text {
+				t.Errorf("expected body %q, got %q", test.text, content.Body)
+			}
+			if len(test.formatted) == 0 {
+				if content.Format != "" || content.FormattedBody != "" || content.Mentions != nil {
+					t.Errorf("expected no formatting, got %q with %+v", content.FormattedBody, content.Mentions)
+				}
+				return
+			}
+			if content.Format != event.FormatHTML || content.FormattedBody != test.formatted {
+				t.Errorf("expected formatted body %q, got %q", test.formatted, content.FormattedBody)
+			}
+			if content.Mentions == nil || !reflect.DeepEqual(content.Mentions.UserIDs, test.mentioned) {
+				t.Errorf("expected mentions %v, got %+v", test.mentioned, content.Mentions)
+			}
+		})
+	}
+}
@@ -5,6 +5,7 @@ go 1.19
 require (
 	github.com/beeper/groupme-lib v0.2.1-0.20221021205945-8f23e04eea71
 	github.com/gabriel-vasile/mimetype v1.1.2
+	github.com/google/uuid v1.2.0
 	github.com/karmanyaahm/wray v0.0.0-20210303233435-756d58657c14
 	github.com/lib/pq v1.10.7
 	github.com/mattn/go-sqlite3 v1.14.16
@@ -18,7 +19,6 @@ require (
 	github.com/cespare/xxhash/v2 v2.1.1 // indirect
 	github.com/coreos/go-systemd/v22 v22.3.3-0.20220203105225-a9a7ef127534 // indirect
 	github.com/golang/protobuf v1.4.3 // indirect
-	github.com/google/uuid v1.2.0 // indirect
 	github.com/gorilla/mux v1.8.0 // indirect
 	github.com/gorilla/websocket v1.5.0 // indirect
 	github.com/mattn/go-colorable v0.1.12 // indirect
@@ -0,0 +1,69 @@
+package groupmeext
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+
+	"github.com/beeper/groupme-lib"
+)
+
+type apiResponse struct {
+	Response json.RawMessage `json:"response"`
+	Meta     groupme.Meta    `json:"meta"`
+}
+
+// doAPI performs an authenticated request against the GroupMe v3 API for
+// endpoints that groupme-lib doesn't support (or doesn't support fully).
+// Errors returned by the API are returned as *groupme.Meta, same as groupme-lib.
+func (c *Client) doAPI(ctx context.Context, method, path string, body, out interface{}) error {
+	var reqBody io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, groupme.GroupMeAPIBase+path, reqBody)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	query := req.URL.Query()
+	query.Set("token", c.token)
+	req.URL.RawQuery = query.Encode()
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var parsed apiResponse
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if len(data) > 0 {
+		// Some endpoints return an empty body, others don't use the envelope on errors.
+		_ = json.Unmarshal(data, &parsed)
+	}
+	if resp.StatusCode >= 300 {
+		parsed.Meta.Code = groupme.HTTPStatusCode(resp.StatusCode)
+		return &parsed.Meta
+	}
+	if out == nil || len(parsed.Response) == 0 {
+		return nil
+	}
+	return json.Unmarshal(parsed.Response, out)
+}
+
+func escapePath(id groupme.ID) string {
+	return url.PathEscape(id.String())
+}
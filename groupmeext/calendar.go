@@ -0,0 +1,111 @@
+package groupmeext
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/beeper/groupme-lib"
+)
+
+type CalendarLocation struct {
+	Name    string `json:"name"`
+	Address string `json:"address,omitempty"`
+	Lat     string `json:"lat,omitempty"`
+	Lng     string `json:"lng,omitempty"`
+}
+
+// CalendarEvent is an event in the calendar of a group.
+type CalendarEvent struct {
+	EventID        string            `json:"event_id"`
+	ConversationID groupme.ID        `json:"conversation_id"`
+	CreatorID      groupme.ID        `json:"creator_id"`
+	Name           string            `json:"name"`
+	Description    string            `json:"description,omitempty"`
+	Location       *CalendarLocation `json:"location,omitempty"`
+	StartAt        time.Time         `json:"start_at"`
+	EndAt          time.Time         `json:"end_at"`
+	IsAllDay       bool              `json:"is_all_day"`
+	Timezone       string            `json:"timezone"`
+	Going          []groupme.ID      `json:"going"`
+	NotGoing       []groupme.ID      `json:"not_going"`
+	CreatedAt      time.Time         `json:"created_at"`
+	UpdatedAt      time.Time         `json:"updated_at"`
+	CanceledAt     *time.Time        `json:"canceled_at,omitempty"`
+	DeletedAt      *time.Time        `json:"deleted_at,omitempty"`
+}
+
+// IsCanceled returns whether the event was cancelled or deleted.
+func (evt *CalendarEvent) IsCanceled() bool {
+	return evt.CanceledAt != nil || evt.DeletedAt != nil
+}
+
+// GetLocation returns the timezone of the event, falling back to the
+// location of the start time if the timezone is unknown.
+func (evt *CalendarEvent) GetLocation() *time.Location {
+	if loc, err := time.LoadLocation(evt.Timezone); len(evt.Timezone) > 0 && err == nil {
+		return loc
+	}
+	return evt.StartAt.Location()
+}
+
+func calendarPath(groupID groupme.ID, action string) string {
+	return "/conversations/" + escapePath(groupID) + "/events/" + action
+}
+
+// GetCalendarEvent fetches an event in the calendar of a group.
+func (c *Client) GetCalendarEvent(ctx context.Context, groupID groupme.ID, eventID string) (*CalendarEvent, error) {
+	var resp struct {
+		Event CalendarEvent `json:"event"`
+	}
+	err := c.doAPI(ctx, http.MethodGet, calendarPath(groupID, "show")+"?event_id="+url.QueryEscape(eventID), nil, &resp)
+	if err != nil {
+		return nil, err
+	}
+	return &resp.Event, nil
+}
+
+// GetCalendarEvents fetches the most recent events in the calendar of a group.
+func (c *Client) GetCalendarEvents(ctx context.Context, groupID groupme.ID, limit int) ([]*CalendarEvent, error) {
+	var resp struct {
+		Events []*CalendarEvent `json:"events"`
+	}
+	err := c.doAPI(ctx, http.MethodGet, calendarPath(groupID, "list")+"?limit="+strconv.Itoa(limit), nil, &resp)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Events, nil
+}
+
+// CalendarEventCreate is the request body for creating a calendar event.
+type CalendarEventCreate struct {
+	Name        string            `json:"name"`
+	Description string            `json:"description"`
+	Location    *CalendarLocation `json:"location,omitempty"`
+	StartAt     time.Time         `json:"start_at"`
+	EndAt       time.Time         `json:"end_at"`
+	IsAllDay    bool              `json:"is_all_day"`
+	Timezone    string            `json:"timezone"`
+	Reminders   []int             `json:"reminders"`
+}
+
+// CreateCalendarEvent creates an event in the calendar of a group. GroupMe
+// posts a message with the event attached to the group on its own.
+func (c *Client) CreateCalendarEvent(ctx context.Context, groupID groupme.ID, evt *CalendarEventCreate) (*CalendarEvent, error) {
+	var resp struct {
+		Event CalendarEvent `json:"event"`
+	}
+	err := c.doAPI(ctx, http.MethodPost, calendarPath(groupID, "create"), evt, &resp)
+	if err != nil {
+		return nil, err
+	}
+	return &resp.Event, nil
+}
+
+// RSVPCalendarEvent answers whether the user is going to an event.
+func (c *Client) RSVPCalendarEvent(ctx context.Context, groupID groupme.ID, eventID string, going bool) error {
+	query := url.Values{"event_id": {eventID}, "going": {strconv.FormatBool(going)}}
+	return c.doAPI(ctx, http.MethodPost, calendarPath(groupID, "rsvp")+"?"+query.Encode(), nil, nil)
+}
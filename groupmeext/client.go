@@ -2,20 +2,31 @@ package groupmeext
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
 
 	"github.com/beeper/groupme-lib"
 	log "maunium.net/go/maulogger/v2"
 )
 
+const (
+	addMembersResultsPollInterval = 1 * time.Second
+	addMembersResultsMaxPolls     = 10
+)
+
 type Client struct {
 	*groupme.Client
-	log log.Logger
+	token string
+	log   log.Logger
 }
 
 // NewClient creates a new GroupMe API Client
 func NewClient(authToken string, log log.Logger) *Client {
 	n := Client{
 		Client: groupme.NewClient(authToken),
+		token:  authToken,
 		log:    log,
 	}
 	return &n
@@ -109,5 +120,43 @@ func (c *Client) RemoveFromGroup(uid, groupID groupme.ID) error {
 	if err != nil {
 		return err
 	}
-	return c.RemoveMember(context.TODO(), groupID, group.GetMemberByUserID(uid).ID)
+	member := group.GetMemberByUserID(uid)
+	if member == nil {
+		return fmt.Errorf("%s is not a member of %s", uid, groupID)
+	}
+	return c.RemoveMember(context.TODO(), groupID, member.ID)
+}
+
+// AddToGroup adds a user to a group and waits for GroupMe to confirm that
+// the membership was created. The wait is bounded by the context.
+func (c *Client) AddToGroup(ctx context.Context, uid, groupID groupme.ID, nickname string) error {
+	resultsID, err := c.AddMembers(ctx, groupID, &groupme.Member{
+		UserID:   uid,
+		Nickname: nickname,
+	})
+	if err != nil {
+		return err
+	}
+	for i := 0; i < addMembersResultsMaxPolls; i++ {
+		select {
+		case <-time.After(addMembersResultsPollInterval):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		members, err := c.AddMembersResults(ctx, groupID, resultsID)
+		var meta *groupme.Meta
+		if errors.As(err, &meta) && meta.Code == http.StatusServiceUnavailable {
+			// The results aren't ready yet
+			continue
+		} else if err != nil {
+			return err
+		}
+		for _, member := range members {
+			if member.UserID == uid {
+				return nil
+			}
+		}
+		return fmt.Errorf("GroupMe didn't add %s to %s", uid, groupID)
+	}
+	return fmt.Errorf("timed out waiting for %s to be added to %s", uid, groupID)
 }
@@ -0,0 +1,48 @@
+package groupmeext
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/beeper/groupme-lib"
+)
+
+// GroupUpdate contains the group fields to change. Unlike
+// groupme.GroupSettings, fields that are nil are left unchanged.
+type GroupUpdate struct {
+	Name        *string `json:"name,omitempty"`
+	Description *string `json:"description,omitempty"`
+	ImageURL    *string `json:"image_url,omitempty"`
+}
+
+// ShowGroupWithLikeIcon fetches a group like groupme-lib's ShowGroup, but also returns
+// the custom like icon of the group, which groupme-lib doesn't decode. The
+// like icon is nil if the group uses the default heart.
+func (c *Client) ShowGroupWithLikeIcon(ctx context.Context, groupID groupme.ID) (*groupme.Group, *LikeIcon, error) {
+	var data json.RawMessage
+	err := c.doAPI(ctx, http.MethodGet, "/groups/"+escapePath(groupID), nil, &data)
+	if err != nil {
+		return nil, nil, err
+	}
+	var group groupme.Group
+	var likeIcon struct {
+		LikeIcon *LikeIcon `json:"like_icon"`
+	}
+	if err = json.Unmarshal(data, &group); err != nil {
+		return nil, nil, err
+	} else if err = json.Unmarshal(data, &likeIcon); err != nil {
+		return nil, nil, err
+	}
+	return &group, likeIcon.LikeIcon, nil
+}
+
+// UpdateGroupInfo changes the name, description or image of a group.
+func (c *Client) UpdateGroupInfo(ctx context.Context, groupID groupme.ID, update GroupUpdate) (*groupme.Group, error) {
+	var group groupme.Group
+	err := c.doAPI(ctx, http.MethodPost, "/groups/"+escapePath(groupID)+"/update", update, &group)
+	if err != nil {
+		return nil, err
+	}
+	return &group, nil
+}
@@ -0,0 +1,37 @@
+package groupmeext
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/beeper/groupme-lib"
+)
+
+// LikeIcon is the icon of a like. Groups can set a custom like icon from an
+// emoji powerup pack, which is identified by PackID and PackIndex.
+type LikeIcon struct {
+	Type      string `json:"type"`
+	Code      string `json:"code,omitempty"`
+	PackID    int    `json:"pack_id,omitempty"`
+	PackIndex int    `json:"pack_index,omitempty"`
+}
+
+// ReactToMessage reacts to a message with an emoji. GroupMe only allows a
+// single like or reaction per user, so this replaces any previous reaction.
+func (c *Client) ReactToMessage(ctx context.Context, conversationID, messageID groupme.ID, emoji string) error {
+	body := map[string]*LikeIcon{
+		"like_icon": {Type: "unicode", Code: emoji},
+	}
+	return c.doAPI(ctx, http.MethodPost, "/messages/"+escapePath(conversationID)+"/"+escapePath(messageID)+"/like", body, nil)
+}
+
+// MessageReaction is an entry in the reactions list of a GroupMe message.
+// Unicode reactions have the emoji in Code, while powerup emoji reactions
+// refer to an emoji in a pack.
+type MessageReaction struct {
+	Type      string       `json:"type"`
+	Code      string       `json:"code,omitempty"`
+	PackID    int          `json:"pack_id,omitempty"`
+	PackIndex int          `json:"pack_index,omitempty"`
+	UserIDs   []groupme.ID `json:"user_ids"`
+}
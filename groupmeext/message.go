@@ -2,6 +2,7 @@ package groupmeext
 
 import (
 	"bytes"
+	"context"
 	"database/sql/driver"
 	"encoding/json"
 	"errors"
@@ -134,3 +135,41 @@ type ImgData struct {
 		Mime     string `json:"mime_type"`
 	} `json:"file_data"`
 }
+
+// MessageDetails are the parts of a group message that groupme-lib doesn't
+// decode. Users who reacted with an emoji are included in FavoritedBy as well.
+type MessageDetails struct {
+	FavoritedBy []groupme.ID         `json:"favorited_by"`
+	Reactions   []*MessageReaction   `json:"reactions"`
+	Attachments []*AttachmentDetails `json:"attachments"`
+}
+
+// AttachmentDetails contains the attachment fields that groupme-lib drops.
+type AttachmentDetails struct {
+	Type    string     `json:"type"`
+	PollID  groupme.ID `json:"poll_id,omitempty"`
+	EventID string     `json:"event_id,omitempty"`
+}
+
+// GetAttachment returns the first attachment of the given type.
+func (md *MessageDetails) GetAttachment(attachmentType string) *AttachmentDetails {
+	for _, attachment := range md.Attachments {
+		if attachment.Type == attachmentType {
+			return attachment
+		}
+	}
+	return nil
+}
+
+// GetMessageDetails fetches a group message with the fields that
+// groupme-lib drops when decoding messages, like the reactions list.
+func (c *Client) GetMessageDetails(ctx context.Context, groupID, messageID groupme.ID) (*MessageDetails, error) {
+	var resp struct {
+		Message MessageDetails `json:"message"`
+	}
+	err := c.doAPI(ctx, http.MethodGet, "/groups/"+escapePath(groupID)+"/messages/"+escapePath(messageID), nil, &resp)
+	if err != nil {
+		return nil, err
+	}
+	return &resp.Message, nil
+}
@@ -0,0 +1,88 @@
+package groupmeext
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/beeper/groupme-lib"
+)
+
+const (
+	PollTypeSingle = "single"
+	PollTypeMulti  = "multi"
+
+	PollVisibilityPublic    = "public"
+	PollVisibilityAnonymous = "anonymous"
+
+	PollStatusActive = "active"
+)
+
+type PollOption struct {
+	ID       string       `json:"id,omitempty"`
+	Title    string       `json:"title"`
+	Votes    int          `json:"votes,omitempty"`
+	VoterIDs []groupme.ID `json:"voter_ids,omitempty"`
+}
+
+// Poll is a GroupMe poll. Voter IDs of the options are only available in
+// public polls.
+type Poll struct {
+	ID             groupme.ID    `json:"id"`
+	Subject        string        `json:"subject"`
+	OwnerID        groupme.ID    `json:"owner_id"`
+	ConversationID groupme.ID    `json:"conversation_id"`
+	Expiration     int64         `json:"expiration"`
+	Status         string        `json:"status"`
+	Type           string        `json:"type"`
+	Visibility     string        `json:"visibility"`
+	Options        []*PollOption `json:"options"`
+}
+
+// IsActive returns whether the poll can still be voted in.
+func (poll *Poll) IsActive() bool {
+	return poll.Status == PollStatusActive && (poll.Expiration == 0 || time.Unix(poll.Expiration, 0).After(time.Now()))
+}
+
+type pollResponse struct {
+	Poll struct {
+		Data Poll `json:"data"`
+	} `json:"poll"`
+}
+
+// GetPoll fetches a poll in a group.
+func (c *Client) GetPoll(ctx context.Context, groupID, pollID groupme.ID) (*Poll, error) {
+	var resp pollResponse
+	err := c.doAPI(ctx, http.MethodGet, "/poll/"+escapePath(groupID)+"/"+escapePath(pollID), nil, &resp)
+	if err != nil {
+		return nil, err
+	}
+	return &resp.Poll.Data, nil
+}
+
+// PollCreate is the request body for creating a poll.
+type PollCreate struct {
+	Subject    string        `json:"subject"`
+	Options    []*PollOption `json:"options"`
+	Expiration int64         `json:"expiration"`
+	Type       string        `json:"type"`
+	Visibility string        `json:"visibility"`
+}
+
+// CreatePoll creates a poll in a group. GroupMe posts a message with the
+// poll attached to the group on its own.
+func (c *Client) CreatePoll(ctx context.Context, groupID groupme.ID, poll *PollCreate) (*Poll, error) {
+	var resp pollResponse
+	err := c.doAPI(ctx, http.MethodPost, "/poll/"+escapePath(groupID), poll, &resp)
+	if err != nil {
+		return nil, err
+	}
+	return &resp.Poll.Data, nil
+}
+
+// Vote votes for an option in a poll. Voting in a single choice poll replaces
+// the previous vote, while multiple choice polls keep all voted options.
+func (c *Client) Vote(ctx context.Context, groupID, pollID groupme.ID, optionID string) error {
+	return c.doAPI(ctx, http.MethodPost, "/poll/"+escapePath(groupID)+"/"+escapePath(pollID)+"/"+url.PathEscape(optionID), nil, nil)
+}
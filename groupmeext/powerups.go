@@ -0,0 +1,72 @@
+package groupmeext
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+const powerupsURL = "https://powerup.groupme.com/powerups"
+
+// EmojiSheet is an image of all the emojis in a pack, stacked vertically in
+// squares of Width by Height pixels.
+type EmojiSheet struct {
+	Width    int    `json:"x"`
+	Height   int    `json:"y"`
+	ImageURL string `json:"image_url"`
+}
+
+// EmojiPack is a GroupMe emoji powerup. Emojis are identified by the pack ID
+// and their index in the pack.
+type EmojiPack struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	Type string `json:"type"`
+	Meta struct {
+		PackID           int           `json:"pack_id"`
+		Transliterations []string      `json:"transliterations"`
+		Inline           []*EmojiSheet `json:"inline"`
+	} `json:"meta"`
+}
+
+// GetLargestSheet returns the emoji sheet with the largest emojis.
+func (pack *EmojiPack) GetLargestSheet() *EmojiSheet {
+	var largest *EmojiSheet
+	for _, sheet := range pack.Meta.Inline {
+		if largest == nil || sheet.Width > largest.Width {
+			largest = sheet
+		}
+	}
+	return largest
+}
+
+// GetEmojiPacks fetches the list of emoji powerup packs. The list is public,
+// so no token is needed.
+func GetEmojiPacks(ctx context.Context) ([]*EmojiPack, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, powerupsURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	var data struct {
+		Powerups []*EmojiPack `json:"powerups"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		return nil, err
+	}
+	packs := data.Powerups[:0]
+	for _, pack := range data.Powerups {
+		if pack.Type == "emoji" {
+			packs = append(packs, pack)
+		}
+	}
+	return packs, nil
+}
@@ -0,0 +1,115 @@
+package groupmeext
+
+import (
+	"encoding/json"
+	"sync"
+
+	"github.com/beeper/groupme-lib"
+)
+
+// HandlerMessageDeleted is implemented by push handlers that want to know
+// about deleted messages.
+type HandlerMessageDeleted interface {
+	HandleMessageDeleted(chat, messageID groupme.ID)
+}
+
+// HandlerPollUpdate is implemented by push handlers that want to know when a
+// poll was created or has finished.
+type HandlerPollUpdate interface {
+	HandlePollUpdate(chat, pollID groupme.ID)
+}
+
+// HandlerCalendarEvent is implemented by push handlers that want to know when
+// a calendar event was created, changed or RSVPed to.
+type HandlerCalendarEvent interface {
+	HandleCalendarEvent(chat groupme.ID, eventID string)
+}
+
+// groupme-lib only passes push events to handlers of the interfaces it knows
+// about, so handlers for the events added here are tracked separately.
+var (
+	pushHandlers     = make(map[*groupme.PushSubscription]interface{})
+	pushHandlersLock sync.RWMutex
+)
+
+// AddPushHandler registers a handler for the push events that groupme-lib
+// doesn't support. The handler should implement the Handler* interfaces of
+// this package for the events it wants to receive.
+func AddPushHandler(r *groupme.PushSubscription, h interface{}) {
+	pushHandlersLock.Lock()
+	pushHandlers[r] = h
+	pushHandlersLock.Unlock()
+}
+
+// RemovePushHandler unregisters the handler of a push subscription that is no
+// longer used.
+func RemovePushHandler(r *groupme.PushSubscription) {
+	pushHandlersLock.Lock()
+	delete(pushHandlers, r)
+	pushHandlersLock.Unlock()
+}
+
+func getPushHandler(r *groupme.PushSubscription) interface{} {
+	pushHandlersLock.RLock()
+	defer pushHandlersLock.RUnlock()
+	return pushHandlers[r]
+}
+
+func init() {
+	groupme.RealTimeSystemHandlers["message.deleted"] = func(r *groupme.PushSubscription, _ string, chat groupme.ID, rawData []byte) {
+		var data struct {
+			MessageID groupme.ID `json:"message_id"`
+		}
+		if err := json.Unmarshal(rawData, &data); err != nil || len(data.MessageID) == 0 {
+			return
+		}
+		if h, ok := getPushHandler(r).(HandlerMessageDeleted); ok {
+			h.HandleMessageDeleted(chat, data.MessageID)
+		}
+	}
+
+	pollHandler := func(r *groupme.PushSubscription, _ string, chat groupme.ID, rawData []byte) {
+		var data struct {
+			Poll struct {
+				ID groupme.ID `json:"id"`
+			} `json:"poll"`
+		}
+		if err := json.Unmarshal(rawData, &data); err != nil || len(data.Poll.ID) == 0 {
+			return
+		}
+		if h, ok := getPushHandler(r).(HandlerPollUpdate); ok {
+			h.HandlePollUpdate(chat, data.Poll.ID)
+		}
+	}
+	groupme.RealTimeSystemHandlers["poll.created"] = pollHandler
+	groupme.RealTimeSystemHandlers["poll.finished"] = pollHandler
+
+	calendarHandler := func(r *groupme.PushSubscription, _ string, chat groupme.ID, rawData []byte) {
+		var data struct {
+			Event struct {
+				ID      string `json:"id"`
+				EventID string `json:"event_id"`
+			} `json:"event"`
+		}
+		if err := json.Unmarshal(rawData, &data); err != nil {
+			return
+		}
+		eventID := data.Event.EventID
+		if len(eventID) == 0 {
+			eventID = data.Event.ID
+		}
+		if h, ok := getPushHandler(r).(HandlerCalendarEvent); ok && len(eventID) > 0 {
+			h.HandleCalendarEvent(chat, eventID)
+		}
+	}
+	for _, kind := range []string{
+		"calendar.event.created",
+		"calendar.event.updated",
+		"calendar.event.cancelled",
+		"calendar.event.user.going",
+		"calendar.event.user.not_going",
+		"calendar.event.user.undecided",
+	} {
+		groupme.RealTimeSystemHandlers[kind] = calendarHandler
+	}
+}
@@ -0,0 +1,70 @@
+package groupmeext
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/beeper/groupme-lib"
+	"github.com/google/uuid"
+)
+
+// Attachment types that groupme-lib doesn't define constants for.
+const (
+	ReplyAttachment = "reply"
+	VideoAttachment = "video"
+	FileAttachment  = "file"
+)
+
+type outgoingAttachment struct {
+	*groupme.Attachment
+	BaseReplyID groupme.ID `json:"base_reply_id,omitempty"`
+}
+
+type outgoingMessage struct {
+	SourceGUID  string                `json:"source_guid"`
+	Text        string                `json:"text"`
+	RecipientID groupme.ID            `json:"recipient_id,omitempty"`
+	Attachments []*outgoingAttachment `json:"attachments"`
+}
+
+// SendMessage sends a message to a group or, if private is set, as a direct
+// message to msg.RecipientID. Unlike groupme-lib's CreateMessage, it keeps
+// the source GUID if one is already set and fills in base_reply_id on reply
+// attachments, which GroupMe requires for replies to be displayed.
+func (c *Client) SendMessage(ctx context.Context, msg *groupme.Message, private bool) (*groupme.Message, error) {
+	if len(msg.SourceGUID) == 0 {
+		msg.SourceGUID = uuid.New().String()
+	}
+	out := &outgoingMessage{
+		SourceGUID:  msg.SourceGUID,
+		Text:        msg.Text,
+		Attachments: make([]*outgoingAttachment, len(msg.Attachments)),
+	}
+	for i, attachment := range msg.Attachments {
+		out.Attachments[i] = &outgoingAttachment{Attachment: attachment}
+		if attachment.Type == ReplyAttachment {
+			// The bridge doesn't track reply threads, so the message being
+			// replied to is used as the base of the thread.
+			out.Attachments[i].BaseReplyID = attachment.ReplyID
+		}
+	}
+
+	if private {
+		out.RecipientID = msg.RecipientID
+		var resp struct {
+			Message *groupme.Message `json:"direct_message"`
+		}
+		err := c.doAPI(ctx, http.MethodPost, "/direct_messages", map[string]*outgoingMessage{"direct_message": out}, &resp)
+		return resp.Message, err
+	}
+	var resp struct {
+		Message *groupme.Message `json:"message"`
+	}
+	err := c.doAPI(ctx, http.MethodPost, "/groups/"+escapePath(msg.GroupID)+"/messages", map[string]*outgoingMessage{"message": out}, &resp)
+	return resp.Message, err
+}
+
+// DeleteMessage deletes a message in a group or direct message conversation.
+func (c *Client) DeleteMessage(ctx context.Context, conversationID, messageID groupme.ID) error {
+	return c.doAPI(ctx, http.MethodDelete, "/conversations/"+escapePath(conversationID)+"/messages/"+escapePath(messageID), nil, nil)
+}
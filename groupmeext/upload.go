@@ -0,0 +1,165 @@
+package groupmeext
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/beeper/groupme-lib"
+	log "maunium.net/go/maulogger/v2"
+)
+
+const (
+	imageServiceURL = "https://image.groupme.com/pictures"
+	videoServiceURL = "https://video.groupme.com/transcode"
+	fileServiceURL  = "https://file.groupme.com/v1/%s/files"
+
+	uploadStatusPollInterval = 2 * time.Second
+	uploadStatusMaxPolls     = 90
+)
+
+var ErrUploadProcessingFailed = errors.New("groupme failed to process the upload")
+
+type uploadStatus struct {
+	Status       string `json:"status"`
+	StatusURL    string `json:"status_url"`
+	URL          string `json:"url"`
+	ThumbnailURL string `json:"thumbnail_url"`
+	FileID       string `json:"file_id"`
+}
+
+func doUploadRequest(req *http.Request, token string, out interface{}) error {
+	req.Header.Set("X-Access-Token", token)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(resp.Body)
+		return &groupme.Meta{
+			Code:   groupme.HTTPStatusCode(resp.StatusCode),
+			Errors: []string{string(body)},
+		}
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// waitForUpload polls the status URL returned by the video and file services
+// until the upload has been processed.
+func waitForUpload(statusURL, token string, log log.Logger) (*uploadStatus, error) {
+	for i := 0; i < uploadStatusMaxPolls; i++ {
+		req, err := http.NewRequest(http.MethodGet, statusURL, nil)
+		if err != nil {
+			return nil, err
+		}
+		var status uploadStatus
+		err = doUploadRequest(req, token, &status)
+		if err != nil {
+			return nil, err
+		}
+		switch status.Status {
+		case "complete", "completed":
+			return &status, nil
+		case "failed", "error":
+			return nil, ErrUploadProcessingFailed
+		}
+		log.Debugfln("Upload at %s is still %s", statusURL, status.Status)
+		time.Sleep(uploadStatusPollInterval)
+	}
+	return nil, fmt.Errorf("timed out waiting for upload at %s", statusURL)
+}
+
+// UploadImage uploads an image to the GroupMe image service and returns
+// the i.groupme.com URL that can be used in an image attachment.
+func UploadImage(data []byte, mime, token string, log log.Logger) (string, error) {
+	req, err := http.NewRequest(http.MethodPost, imageServiceURL, bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", mime)
+	var resp struct {
+		Payload struct {
+			URL        string `json:"url"`
+			PictureURL string `json:"picture_url"`
+		} `json:"payload"`
+	}
+	err = doUploadRequest(req, token, &resp)
+	if err != nil {
+		log.Errorln("Failed to upload image:", err)
+		return "", err
+	}
+	if len(resp.Payload.URL) == 0 {
+		return resp.Payload.PictureURL, nil
+	}
+	return resp.Payload.URL, nil
+}
+
+// UploadVideo uploads a video to the GroupMe video service and waits for it
+// to be transcoded. It returns the video URL and the preview image URL.
+func UploadVideo(conversationID groupme.ID, fileName string, data []byte, token string, log log.Logger) (videoURL, previewURL string, err error) {
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	part, err := writer.CreateFormFile("file", fileName)
+	if err != nil {
+		return "", "", err
+	}
+	_, err = part.Write(data)
+	if err != nil {
+		return "", "", err
+	}
+	err = writer.Close()
+	if err != nil {
+		return "", "", err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, videoServiceURL, &body)
+	if err != nil {
+		return "", "", err
+	}
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	req.Header.Set("X-Conversation-Id", conversationID.String())
+	var job uploadStatus
+	err = doUploadRequest(req, token, &job)
+	if err != nil {
+		log.Errorln("Failed to upload video:", err)
+		return "", "", err
+	}
+
+	status, err := waitForUpload(job.StatusURL, token, log)
+	if err != nil {
+		log.Errorln("Failed to transcode video:", err)
+		return "", "", err
+	}
+	return status.URL, status.ThumbnailURL, nil
+}
+
+// UploadFile uploads a generic file to the GroupMe file service and returns
+// the file ID that can be used in a file attachment.
+func UploadFile(conversationID groupme.ID, fileName string, data []byte, token string, log log.Logger) (string, error) {
+	uploadURL := fmt.Sprintf(fileServiceURL, conversationID) + "?name=" + url.QueryEscape(fileName)
+	req, err := http.NewRequest(http.MethodPost, uploadURL, bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	var job uploadStatus
+	err = doUploadRequest(req, token, &job)
+	if err != nil {
+		log.Errorln("Failed to upload file:", err)
+		return "", err
+	}
+
+	status, err := waitForUpload(job.StatusURL, token, log)
+	if err != nil {
+		log.Errorln("Failed to process uploaded file:", err)
+		return "", err
+	}
+	return status.FileID, nil
+}
@@ -24,6 +24,7 @@ import (
 	"maunium.net/go/mautrix/bridge"
 	"maunium.net/go/mautrix/bridge/commands"
 	"maunium.net/go/mautrix/bridge/status"
+	"maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/id"
 	"maunium.net/go/mautrix/util/configupgrade"
 
@@ -31,6 +32,7 @@ import (
 
 	"github.com/beeper/groupme/config"
 	"github.com/beeper/groupme/database"
+	"github.com/beeper/groupme/groupmeext"
 )
 
 // Information to find out exactly which commit the bridge was built from.
@@ -64,13 +66,21 @@ type GMBridge struct {
 	puppets             map[groupme.ID]*Puppet
 	puppetsByCustomMXID map[id.UserID]*Puppet
 	puppetsLock         sync.Mutex
+	emojiPacks          map[int]*groupmeext.EmojiPack
+	emojiPacksLock      sync.Mutex
+	emojiUploads        map[int]bool
+	emojiUploadsLock    sync.Mutex
 }
 
 func (br *GMBridge) Init() {
 	br.CommandProcessor = commands.NewProcessor(&br.Bridge)
 	br.RegisterCommands()
 
+	matrixHTMLParser = newMatrixHTMLParser(&br.Config.Bridge.Formatting)
 	matrixHTMLParser.PillConverter = br.pillConverter
+	br.EventProcessor.On(event.StateMember, br.HandleMatrixMembership)
+	br.EventProcessor.On(EventPollStart, br.MatrixHandler.HandleMessage)
+	br.EventProcessor.On(EventPollResponse, br.MatrixHandler.HandleReaction)
 
 	Segment.log = br.Log.Sub("Segment")
 	Segment.key = br.Config.SegmentKey
@@ -116,6 +126,8 @@ func (br *GMBridge) StartUsers() {
 	if !foundAnySessions {
 		br.SendGlobalBridgeState(status.BridgeState{StateEvent: status.StateUnconfigured}.Fill(nil))
 	}
+	br.Log.Debugln("Resuming queued outgoing messages")
+	br.ResumeOutboxes()
 	br.Log.Debugln("Starting custom puppets")
 	for _, loopuppet := range br.GetAllPuppetsWithCustomMXID() {
 		go func(puppet *Puppet) {
@@ -136,6 +148,7 @@ func (br *GMBridge) Stop() {
 			continue
 		}
 		br.Log.Debugln("Disconnecting", user.MXID)
+		user.DeleteConnection()
 	}
 }
 
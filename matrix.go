@@ -20,7 +20,9 @@ import (
 	"fmt"
 
 	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/appservice"
 	"maunium.net/go/mautrix/bridge"
+	"maunium.net/go/mautrix/bridge/bridgeconfig"
 	"maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/format"
 	"maunium.net/go/mautrix/id"
@@ -101,3 +103,35 @@ func (br *GMBridge) createPrivatePortalFromInvite(roomID id.RoomID, inviter *Use
 	portal.UpdateBridgeInfo()
 	_, _ = intent.SendNotice(roomID, "Private chat portal created")
 }
+
+// HandleMatrixMembership handles the membership changes that the member event
+// handler in mautrix doesn't pass on to portals: bans of GroupMe puppets and
+// invites of Matrix users who are logged into the bridge.
+func (br *GMBridge) HandleMatrixMembership(evt *event.Event) {
+	content := evt.Content.AsMember()
+	if (content.Membership != event.MembershipBan && content.Membership != event.MembershipInvite) ||
+		evt.Sender == br.Bot.UserID || br.IsGhost(evt.Sender) {
+		return
+	} else if val, ok := evt.Content.Raw[appservice.DoublePuppetKey]; ok && val == br.Name {
+		return
+	}
+	user := br.GetUserByMXIDIfExists(evt.Sender)
+	if user == nil || user.GetPermissionLevel() < bridgeconfig.PermissionLevelUser || !user.IsLoggedIn() {
+		return
+	}
+	portal := br.GetPortalByMXID(evt.RoomID)
+	if portal == nil {
+		return
+	}
+	target := id.UserID(evt.GetStateKey())
+	if content.Membership == event.MembershipBan {
+		if puppet := br.GetPuppetByMXID(target); puppet != nil {
+			portal.HandleMatrixKick(user, puppet)
+		}
+	} else if !br.IsGhost(target) && target != evt.Sender {
+		invitee := br.GetUserByMXIDIfExists(target)
+		if invitee != nil && len(invitee.GMID) > 0 {
+			portal.addToGroup(user, invitee.GMID, br.GetPuppetByGMID(invitee.GMID).Displayname)
+		}
+	}
+}
@@ -17,26 +17,161 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io"
+	"net"
+	"net/http"
 	"sync"
 
+	"github.com/beeper/groupme-lib"
 	log "maunium.net/go/maulogger/v2"
 
 	"maunium.net/go/mautrix"
 	"maunium.net/go/mautrix/bridge/status"
 	"maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/id"
+
+	"github.com/beeper/groupme/groupmeext"
 )
 
 var (
-	errMessageTakingLong = errors.New("bridging the message is taking longer than usual")
+	errMessageTakingLong     = errors.New("bridging the message is taking longer than usual")
+	errMessageQueued         = errors.New("message is queued for sending to GroupMe")
+	errMessageDropped        = errors.New("message was dropped from the outbox")
+	errOutboxGaveUp          = errors.New("gave up sending the message to GroupMe")
+	errMediaDownloadFailed   = errors.New("failed to download media")
+	errMediaDecryptFailed    = errors.New("failed to decrypt media")
+	errMediaUploadFailed     = errors.New("failed to upload media")
+	errMediaProcessingFailed = errors.New("GroupMe failed to process the media")
+
+	errUnexpectedParsedContentType = errors.New("unexpected parsed content type")
+	errUnknownMsgType              = errors.New("unknown msgtype")
+
+	errUserNotLoggedIn           = errors.New("user is not logged in")
+	errRelaybotNotLoggedIn       = errors.New("neither user nor relay bot of chat are logged in")
+	errTargetNotFound            = errors.New("target event not found")
+	errReactionTargetNotFound    = errors.New("target event for reaction not found")
+	errReactionSentBySomeoneElse = errors.New("target reaction was sent by someone else")
+
+	errPollPrivateChat      = errors.New("GroupMe doesn't support polls in private chats")
+	errPollRelayUnsupported = errors.New("polls can't be sent through the relay user")
+	errPollTooFewAnswers    = errors.New("poll has too few answers for GroupMe")
+	errPollTooManyAnswers   = errors.New("poll has too many answers for GroupMe")
+	errPollTextTooLong      = errors.New("poll text is too long for GroupMe")
+	errPollEnded            = errors.New("poll has already ended")
+	errPollUnknownAnswer    = errors.New("unknown poll answer")
+	errPollVoteRetract      = errors.New("GroupMe doesn't support retracting poll votes")
+
+	errRateLimited       = errors.New("rate limited by GroupMe")
+	errGroupMeAuthFailed = errors.New("GroupMe rejected the access token")
+	errChatNotFound      = errors.New("chat not found on GroupMe")
+	errMessageTooLarge   = errors.New("message is too large for GroupMe")
+	errGroupMeNetwork    = errors.New("failed to reach GroupMe")
 )
 
+// wrapGroupMeError wraps an error returned by the GroupMe API in one of the
+// error types above, so that errorToStatusReason can report it properly.
+func wrapGroupMeError(err error) error {
+	var meta *groupme.Meta
+	var netErr net.Error
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, context.DeadlineExceeded):
+		return err
+	case errors.As(err, &meta):
+		switch {
+		case meta.Code == http.StatusTooManyRequests, meta.Code == groupme.HTTPEnhanceYourCalm:
+			return fmt.Errorf("%w: %v", errRateLimited, err)
+		case meta.Code == http.StatusUnauthorized:
+			return fmt.Errorf("%w: %v", errGroupMeAuthFailed, err)
+		case meta.Code == http.StatusForbidden, meta.Code == http.StatusNotFound:
+			return fmt.Errorf("%w: %v", errChatNotFound, err)
+		case meta.Code == http.StatusRequestEntityTooLarge:
+			return fmt.Errorf("%w: %v", errMessageTooLarge, err)
+		case meta.Code >= 500:
+			return fmt.Errorf("%w: %v", errGroupMeNetwork, err)
+		}
+	case errors.As(err, &netErr), errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return fmt.Errorf("%w: %v", errGroupMeNetwork, err)
+	}
+	return err
+}
+
+// wrapMediaUploadError wraps an error from the GroupMe media services. Errors
+// that wrapGroupMeError can classify keep that classification, so that e.g. a
+// file that's too large isn't reported as a retriable upload failure.
+func wrapMediaUploadError(err error) error {
+	if errors.Is(err, groupmeext.ErrUploadProcessingFailed) {
+		return fmt.Errorf("%w: %v", errMediaProcessingFailed, err)
+	} else if wrapped := wrapGroupMeError(err); wrapped != err {
+		return fmt.Errorf("failed to upload media: %w", wrapped)
+	}
+	return fmt.Errorf("%w: %v", errMediaUploadFailed, err)
+}
+
+// isRetriableError returns whether a request that failed with the given
+// (wrapped) error may succeed if it's retried later.
+func isRetriableError(err error) bool {
+	return errors.Is(err, errRateLimited) || errors.Is(err, errGroupMeNetwork)
+}
+
+// isAmbiguousSendError returns whether a message may have been sent even
+// though sending it failed with the given (wrapped) error. Rate limit errors
+// aren't ambiguous: GroupMe rejected the message.
+func isAmbiguousSendError(err error) bool {
+	return errors.Is(err, errGroupMeNetwork) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled)
+}
+
 func errorToStatusReason(err error) (reason event.MessageStatusReason, status event.MessageStatus, isCertain, sendNotice bool, humanMessage string) {
 	switch {
 	case errors.Is(err, errMessageTakingLong):
 		return event.MessageStatusTooOld, event.MessageStatusPending, false, true, err.Error()
+	case errors.Is(err, context.DeadlineExceeded):
+		return event.MessageStatusTooOld, event.MessageStatusRetriable, false, true, "Handling the message took too long and was cancelled"
+	case errors.Is(err, errMessageQueued):
+		return event.MessageStatusNetworkError, event.MessageStatusPending, false, false, "Waiting to be sent to GroupMe"
+	case errors.Is(err, errMessageDropped):
+		return event.MessageStatusGenericError, event.MessageStatusFail, true, false, "The message was dropped before it was sent to GroupMe"
+	case errors.Is(err, errOutboxGaveUp):
+		return event.MessageStatusNetworkError, event.MessageStatusFail, false, true, "Gave up sending the message to GroupMe after too many failed attempts"
+	case errors.Is(err, errUserNotLoggedIn):
+		return event.MessageStatusNoPermission, event.MessageStatusFail, true, true, "You're not logged into GroupMe"
+	case errors.Is(err, errRelaybotNotLoggedIn):
+		return event.MessageStatusNoPermission, event.MessageStatusFail, true, true, "Neither you nor the relay user are logged into GroupMe"
+	case errors.Is(err, errGroupMeAuthFailed):
+		return event.MessageStatusNoPermission, event.MessageStatusFail, true, true, "Your GroupMe login is no longer valid"
+	case errors.Is(err, errChatNotFound):
+		return event.MessageStatusNoPermission, event.MessageStatusFail, true, true, "This chat is no longer available on GroupMe"
+	case errors.Is(err, errMessageTooLarge):
+		return event.MessageStatusUnsupported, event.MessageStatusFail, true, true, "The message is too large for GroupMe"
+	case errors.Is(err, errPollPrivateChat),
+		errors.Is(err, errPollRelayUnsupported),
+		errors.Is(err, errPollTooFewAnswers),
+		errors.Is(err, errPollTooManyAnswers),
+		errors.Is(err, errPollTextTooLong),
+		errors.Is(err, errPollEnded),
+		errors.Is(err, errPollUnknownAnswer),
+		errors.Is(err, errPollVoteRetract):
+		return event.MessageStatusUnsupported, event.MessageStatusFail, true, true, err.Error()
+	case errors.Is(err, errUnexpectedParsedContentType), errors.Is(err, errUnknownMsgType):
+		return event.MessageStatusUnsupported, event.MessageStatusFail, true, true, ""
+	case errors.Is(err, errRateLimited):
+		return event.MessageStatusNetworkError, event.MessageStatusRetriable, true, true, "GroupMe is rate limiting messages, try again later"
+	case errors.Is(err, errGroupMeNetwork):
+		return event.MessageStatusNetworkError, event.MessageStatusRetriable, false, true, "Failed to reach GroupMe"
+	case errors.Is(err, errTargetNotFound),
+		errors.Is(err, errReactionTargetNotFound),
+		errors.Is(err, errReactionSentBySomeoneElse):
+		return event.MessageStatusGenericError, event.MessageStatusFail, true, false, ""
+	case errors.Is(err, errMediaDecryptFailed):
+		return event.MessageStatusUndecryptable, event.MessageStatusRetriable, true, true, ""
+	case errors.Is(err, errMediaProcessingFailed):
+		return event.MessageStatusUnsupported, event.MessageStatusFail, true, true, "GroupMe couldn't process the media"
+	case errors.Is(err, errMediaDownloadFailed), errors.Is(err, errMediaUploadFailed):
+		return event.MessageStatusNetworkError, event.MessageStatusRetriable, true, true, ""
 	default:
 		return event.MessageStatusGenericError, event.MessageStatusRetriable, false, true, ""
 	}
@@ -121,6 +256,10 @@ func (portal *Portal) sendMessageMetrics(evt *event.Event, err error, part strin
 		msgType = "reaction"
 	case event.EventRedaction:
 		msgType = "redaction"
+	case EventPollStart:
+		msgType = "poll"
+	case EventPollResponse:
+		msgType = "poll vote"
 	default:
 		msgType = "unknown event"
 	}
@@ -158,6 +297,15 @@ func (portal *Portal) sendMessageMetrics(evt *event.Event, err error, part strin
 	}
 }
 
+// getMatrixHandlingContext returns a context that is cancelled when the
+// message handling deadline from the config is reached.
+func (portal *Portal) getMatrixHandlingContext() (context.Context, context.CancelFunc) {
+	if deadline := portal.bridge.Config.Bridge.MessageHandlingTimeout.Deadline; deadline > 0 {
+		return context.WithTimeout(context.Background(), deadline)
+	}
+	return context.WithCancel(context.Background())
+}
+
 type metricSender struct {
 	portal         *Portal
 	previousNotice id.EventID
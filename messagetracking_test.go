@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/beeper/groupme-lib"
+
+	"maunium.net/go/mautrix/event"
+
+	"github.com/beeper/groupme/groupmeext"
+)
+
+func TestWrapGroupMeError(t *testing.T) {
+	meta := func(code int) error {
+		return &groupme.Meta{Code: groupme.HTTPStatusCode(code), Errors: []string{"test"}}
+	}
+	otherErr := errors.New("something else")
+
+	tests := []struct {
+		name      string
+		err       error
+		expected  error
+		retriable bool
+	}{
+		{"nil", nil, nil, false},
+		{"rate limited", meta(http.StatusTooManyRequests), errRateLimited, true},
+		{"enhance your calm", meta(int(groupme.HTTPEnhanceYourCalm)), errRateLimited, true},
+		{"unauthorized", meta(http.StatusUnauthorized), errGroupMeAuthFailed, false},
+		{"forbidden", meta(http.StatusForbidden), errChatNotFound, false},
+		{"not found", meta(http.StatusNotFound), errChatNotFound, false},
+		{"too large", meta(http.StatusRequestEntityTooLarge), errMessageTooLarge, false},
+		{"server error", meta(http.StatusInternalServerError), errGroupMeNetwork, true},
+		{"service unavailable", meta(http.StatusServiceUnavailable), errGroupMeNetwork, true},
+		{"bad request", meta(http.StatusBadRequest), nil, false},
+		{"wrapped meta", fmt.Errorf("failed to send: %w", meta(http.StatusBadGateway)), errGroupMeNetwork, true},
+		{"network error", &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}, errGroupMeNetwork, true},
+		{"url error", &url.Error{Op: "Post", URL: "https://api.groupme.com", Err: io.EOF}, errGroupMeNetwork, true},
+		{"unexpected eof", io.ErrUnexpectedEOF, errGroupMeNetwork, true},
+		{"deadline", context.DeadlineExceeded, context.DeadlineExceeded, false},
+		{"unknown", otherErr, otherErr, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			wrapped := wrapGroupMeError(test.err)
+			if test.expected == nil && test.err == nil && wrapped != nil {
+				t.Errorf("expected nil, got %v", wrapped)
+			} else if test.expected != nil && !errors.Is(wrapped, test.expected) {
+				t.Errorf("expected %v to wrap %v", wrapped, test.expected)
+			} else if test.expected == nil && test.err != nil && wrapped != test.err {
+				t.Errorf("expected %v to be returned as-is, got %v", test.err, wrapped)
+			}
+			if retriable := isRetriableError(wrapped); retriable != test.retriable {
+				t.Errorf("expected retriable to be %t for %v", test.retriable, wrapped)
+			}
+		})
+	}
+}
+
+func TestWrapMediaUploadError(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		expected error
+		status   event.MessageStatus
+	}{
+		{"processing failed", groupmeext.ErrUploadProcessingFailed, errMediaProcessingFailed, event.MessageStatusFail},
+		{"too large", &groupme.Meta{Code: http.StatusRequestEntityTooLarge}, errMessageTooLarge, event.MessageStatusFail},
+		{"rate limited", &groupme.Meta{Code: http.StatusTooManyRequests}, errRateLimited, event.MessageStatusRetriable},
+		{"unknown", errors.New("unexpected response"), errMediaUploadFailed, event.MessageStatusRetriable},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			wrapped := wrapMediaUploadError(test.err)
+			if !errors.Is(wrapped, test.expected) {
+				t.Errorf("expected %v to wrap %v", wrapped, test.expected)
+			}
+			if _, status, _, _, _ := errorToStatusReason(wrapped); status != test.status {
+				t.Errorf("expected status %s, got %s", test.status, status)
+			}
+		})
+	}
+}
+
+func TestErrorToStatusReason(t *testing.T) {
+	tests := []struct {
+		name   string
+		err    error
+		reason event.MessageStatusReason
+		status event.MessageStatus
+	}{
+		{"queued", fmt.Errorf("%w: %v", errMessageQueued, errGroupMeNetwork), event.MessageStatusNetworkError, event.MessageStatusPending},
+		{"dropped", errMessageDropped, event.MessageStatusGenericError, event.MessageStatusFail},
+		{"gave up", fmt.Errorf("%w after 12 attempts: %v", errOutboxGaveUp, errGroupMeNetwork), event.MessageStatusNetworkError, event.MessageStatusFail},
+		{"not logged in", errUserNotLoggedIn, event.MessageStatusNoPermission, event.MessageStatusFail},
+		{"auth failed", fmt.Errorf("%w: test", errGroupMeAuthFailed), event.MessageStatusNoPermission, event.MessageStatusFail},
+		{"rate limited", fmt.Errorf("%w: test", errRateLimited), event.MessageStatusNetworkError, event.MessageStatusRetriable},
+		{"deadline", fmt.Errorf("failed to send: %w", context.DeadlineExceeded), event.MessageStatusTooOld, event.MessageStatusRetriable},
+		{"poll", errPollTooManyAnswers, event.MessageStatusUnsupported, event.MessageStatusFail},
+		{"unknown msgtype", fmt.Errorf("%w %q", errUnknownMsgType, "m.location"), event.MessageStatusUnsupported, event.MessageStatusFail},
+		{"target not found", fmt.Errorf("%w $event", errTargetNotFound), event.MessageStatusGenericError, event.MessageStatusFail},
+		{"unknown", errors.New("test"), event.MessageStatusGenericError, event.MessageStatusRetriable},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			reason, status, _, _, _ := errorToStatusReason(test.err)
+			if reason != test.reason || status != test.status {
+				t.Errorf("expected %s/%s, got %s/%s", test.reason, test.status, reason, status)
+			}
+		})
+	}
+}
+
+func TestIsAmbiguousSendError(t *testing.T) {
+	tests := []struct {
+		name      string
+		err       error
+		ambiguous bool
+	}{
+		{"network", fmt.Errorf("%w: test", errGroupMeNetwork), true},
+		{"rate limited", fmt.Errorf("%w: test", errRateLimited), false},
+		{"deadline", context.DeadlineExceeded, true},
+		{"canceled", fmt.Errorf("failed to send: %w", context.Canceled), true},
+		{"too large", fmt.Errorf("%w: test", errMessageTooLarge), false},
+		{"chat not found", fmt.Errorf("%w: test", errChatNotFound), false},
+		{"unknown", errors.New("test"), false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if ambiguous := isAmbiguousSendError(test.err); ambiguous != test.ambiguous {
+				t.Errorf("expected ambiguous to be %t for %v", test.ambiguous, test.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,279 @@
+// mautrix-groupme - A Matrix-GroupMe puppeting bridge.
+// Copyright (C) 2022 Sumner Evans, Karmanyaah Malhotra
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/beeper/groupme/database"
+)
+
+const (
+	outboxRetryBaseDelay = 5 * time.Second
+	outboxRetryMaxDelay  = 30 * time.Minute
+	// outboxMaxAttempts is how many times a queued message is tried before
+	// it's failed, which with the delays above is a bit over two hours.
+	outboxMaxAttempts = 12
+)
+
+// queueMatrixMessage stores a Matrix event in the outbox, from where the
+// outbox loop of the portal sends it to GroupMe.
+func (portal *Portal) queueMatrixMessage(sender *User, evt *event.Event) error {
+	if !sender.IsLoggedIn() && portal.GetRelayUser() == nil {
+		if portal.HasRelaybot() {
+			return errRelaybotNotLoggedIn
+		}
+		return errUserNotLoggedIn
+	}
+	item := portal.bridge.DB.Outbox.New()
+	item.Chat = portal.Key
+	item.MXID = evt.ID
+	item.Sender = sender.MXID
+	item.Event = evt
+	item.NextAttempt = time.Now()
+	if evt.Mautrix.WasEncrypted {
+		// Only a reference to encrypted events is stored, so that their
+		// decrypted content doesn't end up in the database. The decrypted
+		// event is kept in memory, and fetched again after a restart.
+		item.Event = &event.Event{
+			Type:      event.EventEncrypted,
+			ID:        evt.ID,
+			RoomID:    evt.RoomID,
+			Sender:    evt.Sender,
+			Timestamp: evt.Timestamp,
+		}
+		portal.outboxLock.Lock()
+		portal.outboxEvents[evt.ID] = evt
+		portal.outboxLock.Unlock()
+	}
+	err := item.Insert()
+	if err != nil {
+		portal.forgetOutboxEvent(evt.ID)
+		return fmt.Errorf("failed to queue message: %w", err)
+	}
+	portal.sendStatusEvent(evt.ID, "", errMessageQueued)
+	portal.wakeOutbox()
+	return nil
+}
+
+func (portal *Portal) wakeOutbox() {
+	select {
+	case portal.outboxWake <- struct{}{}:
+	default:
+	}
+}
+
+// handleOutboxLoop sends the messages in the outbox of the portal one by one,
+// so that they arrive on GroupMe in the order they were sent on Matrix.
+func (portal *Portal) handleOutboxLoop() {
+	for {
+		now := time.Now()
+		portal.outboxLock.Lock()
+		item := portal.bridge.DB.Outbox.GetNext(portal.Key)
+		if item != nil && !item.NextAttempt.After(now) {
+			portal.outboxSending = item.MXID
+		}
+		portal.outboxLock.Unlock()
+		if item == nil {
+			<-portal.outboxWake
+			continue
+		}
+		if wait := item.NextAttempt.Sub(now); wait > 0 {
+			select {
+			case <-portal.outboxWake:
+			case <-time.After(wait):
+			}
+			continue
+		}
+		portal.sendOutboxItem(item)
+		portal.outboxLock.Lock()
+		portal.outboxSending = ""
+		portal.outboxLock.Unlock()
+	}
+}
+
+func outboxRetryDelay(attempts int) time.Duration {
+	delay := outboxRetryBaseDelay
+	for i := 1; i < attempts && delay < outboxRetryMaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > outboxRetryMaxDelay {
+		delay = outboxRetryMaxDelay
+	}
+	return delay
+}
+
+// loadOutboxEvent returns the event of a queued message. Encrypted events are
+// only stored as references, so they're fetched and decrypted again if they
+// aren't in memory anymore.
+func (portal *Portal) loadOutboxEvent(item *database.OutboxItem) (*event.Event, error) {
+	if item.Event.Type != event.EventEncrypted {
+		return item.Event, nil
+	}
+	portal.outboxLock.Lock()
+	evt, ok := portal.outboxEvents[item.MXID]
+	portal.outboxLock.Unlock()
+	if ok {
+		return evt, nil
+	} else if portal.bridge.Crypto == nil {
+		return nil, errors.New("encryption is not enabled")
+	}
+	evt, err := portal.MainIntent().GetEvent(portal.MXID, item.MXID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch event: %w", err)
+	}
+	err = evt.Content.ParseRaw(evt.Type)
+	if err == nil {
+		evt, err = portal.bridge.Crypto.Decrypt(evt)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt event: %w", err)
+	}
+	return evt, nil
+}
+
+func (portal *Portal) forgetOutboxEvent(evtID id.EventID) {
+	portal.outboxLock.Lock()
+	delete(portal.outboxEvents, evtID)
+	portal.outboxLock.Unlock()
+}
+
+// removeOutboxItem deletes an item that won't be sent (again) from the outbox.
+func (portal *Portal) removeOutboxItem(item *database.OutboxItem) {
+	item.Delete()
+	portal.forgetOutboxEvent(item.MXID)
+}
+
+// isOutboxRetriable returns whether sending a queued message that failed with
+// the given error should be tried again later.
+func isOutboxRetriable(sender *User, err error) bool {
+	switch {
+	case isRetriableError(err), errors.Is(err, context.DeadlineExceeded):
+		return true
+	case errors.Is(err, errUserNotLoggedIn), errors.Is(err, errRelaybotNotLoggedIn):
+		// Users that have a GroupMe login may just not be connected yet after
+		// a restart, but there's no point in waiting for anyone else.
+		return sender != nil && sender.HasSession()
+	default:
+		return false
+	}
+}
+
+func (portal *Portal) sendOutboxItem(item *database.OutboxItem) {
+	if item.Event == nil {
+		portal.log.Warnfln("Dropping unreadable event %s from the outbox", item.MXID)
+		portal.removeOutboxItem(item)
+		return
+	}
+	ms := metricSender{portal: portal, retryNum: item.Attempts}
+	evt, err := portal.loadOutboxEvent(item)
+	if err != nil {
+		portal.log.Warnfln("Dropping event %s from the outbox: %v", item.MXID, err)
+		portal.removeOutboxItem(item)
+		ms.sendMessageMetrics(item.Event, err, "Error sending", true)
+		return
+	}
+	// The handling timeouts apply to each attempt rather than to the age of
+	// the event, as messages are expected to wait in the outbox during outages.
+	ctx, cancel := portal.getMatrixHandlingContext()
+	defer cancel()
+	if errorAfter := portal.bridge.Config.Bridge.MessageHandlingTimeout.ErrorAfter; errorAfter > 0 {
+		timer := time.AfterFunc(errorAfter, func() {
+			ms.sendMessageMetrics(evt, errMessageTakingLong, "Timeout handling", false)
+		})
+		defer timer.Stop()
+	}
+	sender := portal.bridge.GetUserByMXID(item.Sender)
+	if sender == nil {
+		err = errUserNotLoggedIn
+	} else {
+		err = portal.handleOutboxEvent(ctx, sender, evt)
+	}
+
+	if err != nil && isOutboxRetriable(sender, err) {
+		if item.Attempts+1 < outboxMaxAttempts {
+			item.Attempts++
+			item.LastError = err.Error()
+			item.NextAttempt = time.Now().Add(outboxRetryDelay(item.Attempts))
+			item.Update()
+			portal.log.Warnfln("Failed to send %s (attempt #%d), retrying at %s: %v", item.MXID, item.Attempts, item.NextAttempt.Format(time.RFC3339), err)
+			portal.sendStatusEvent(item.MXID, "", fmt.Errorf("%w: %v", errMessageQueued, err))
+			return
+		}
+		portal.log.Warnfln("Giving up on sending %s after %d attempts: %v", item.MXID, outboxMaxAttempts, err)
+		err = fmt.Errorf("%w after %d attempts: %v", errOutboxGaveUp, outboxMaxAttempts, err)
+	}
+	portal.removeOutboxItem(item)
+	ms.sendMessageMetrics(evt, err, "Error sending", true)
+}
+
+// handleOutboxEvent sends a queued event to GroupMe.
+func (portal *Portal) handleOutboxEvent(ctx context.Context, sender *User, evt *event.Event) error {
+	switch evt.Type {
+	case event.EventReaction:
+		return portal.handleMatrixReaction(ctx, sender, evt)
+	case EventPollResponse:
+		return portal.handleMatrixPollResponse(ctx, sender, evt)
+	case event.EventRedaction:
+		return portal.handleMatrixRedaction(ctx, sender, evt)
+	default:
+		return portal.handleMatrixMessage(ctx, sender, evt)
+	}
+}
+
+// dropQueuedEvent removes an event from the outbox if it's still waiting to
+// be sent. An event that is being sent right now can't be dropped anymore.
+func (portal *Portal) dropQueuedEvent(evtID id.EventID) bool {
+	portal.outboxLock.Lock()
+	defer portal.outboxLock.Unlock()
+	item := portal.bridge.DB.Outbox.GetByMXID(evtID)
+	if item == nil || item.Chat != portal.Key || portal.outboxSending == evtID {
+		return false
+	}
+	item.Delete()
+	delete(portal.outboxEvents, evtID)
+	portal.log.Debugfln("Dropped redacted event %s from the outbox", evtID)
+	return true
+}
+
+// RetryOutboxItem makes the outbox loop send a queued message immediately.
+func (portal *Portal) RetryOutboxItem(item *database.OutboxItem) {
+	item.NextAttempt = time.Now()
+	item.Update()
+	portal.wakeOutbox()
+}
+
+// DropOutboxItem removes a queued message without sending it.
+func (portal *Portal) DropOutboxItem(item *database.OutboxItem) {
+	portal.removeOutboxItem(item)
+	portal.sendStatusEvent(item.MXID, "", errMessageDropped)
+	portal.wakeOutbox()
+}
+
+// ResumeOutboxes starts the outbox loops of portals that had messages queued
+// when the bridge was stopped.
+func (br *GMBridge) ResumeOutboxes() {
+	for _, key := range br.DB.Outbox.GetChats() {
+		br.GetPortalByGMID(key)
+	}
+}
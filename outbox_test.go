@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/beeper/groupme/database"
+)
+
+func TestOutboxRetryDelay(t *testing.T) {
+	tests := []struct {
+		attempts int
+		expected time.Duration
+	}{
+		{1, 5 * time.Second},
+		{2, 10 * time.Second},
+		{5, 80 * time.Second},
+		{10, 30 * time.Minute},
+		{outboxMaxAttempts, 30 * time.Minute},
+	}
+	for _, test := range tests {
+		if delay := outboxRetryDelay(test.attempts); delay != test.expected {
+			t.Errorf("expected delay after %d attempts to be %s, got %s", test.attempts, test.expected, delay)
+		}
+	}
+}
+
+func TestIsOutboxRetriable(t *testing.T) {
+	loggedOut := &User{User: &database.User{}}
+	connecting := &User{User: &database.User{Token: "token"}}
+
+	tests := []struct {
+		name      string
+		sender    *User
+		err       error
+		retriable bool
+	}{
+		{"network", connecting, fmt.Errorf("%w: test", errGroupMeNetwork), true},
+		{"rate limited", loggedOut, fmt.Errorf("%w: test", errRateLimited), true},
+		{"deadline", connecting, fmt.Errorf("failed to send: %w", context.DeadlineExceeded), true},
+		{"not connected yet", connecting, errUserNotLoggedIn, true},
+		{"relay not connected yet", connecting, errRelaybotNotLoggedIn, true},
+		{"not logged in", loggedOut, errUserNotLoggedIn, false},
+		{"relay not logged in", loggedOut, errRelaybotNotLoggedIn, false},
+		{"unknown sender", nil, errUserNotLoggedIn, false},
+		{"too large", connecting, fmt.Errorf("%w: test", errMessageTooLarge), false},
+		{"unknown", connecting, errors.New("test"), false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if retriable := isOutboxRetriable(test.sender, test.err); retriable != test.retriable {
+				t.Errorf("expected retriable to be %t for %v", test.retriable, test.err)
+			}
+		})
+	}
+}
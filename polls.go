@@ -0,0 +1,436 @@
+// mautrix-groupme - A Matrix-GroupMe puppeting bridge.
+// Copyright (C) 2022 Sumner Evans, Karmanyaah Malhotra
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"maunium.net/go/mautrix/appservice"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/beeper/groupme-lib"
+
+	"github.com/beeper/groupme/database"
+	"github.com/beeper/groupme/groupmeext"
+)
+
+// Polls are bridged as MSC3381 polls, which aren't supported by mautrix-go yet.
+var (
+	EventPollStart    = event.Type{Type: "org.matrix.msc3381.poll.start", Class: event.MessageEventType}
+	EventPollResponse = event.Type{Type: "org.matrix.msc3381.poll.response", Class: event.MessageEventType}
+	EventPollEnd      = event.Type{Type: "org.matrix.msc3381.poll.end", Class: event.MessageEventType}
+)
+
+func init() {
+	event.TypeMap[EventPollStart] = reflect.TypeOf(PollStartEventContent{})
+	event.TypeMap[EventPollResponse] = reflect.TypeOf(PollResponseEventContent{})
+	event.TypeMap[EventPollEnd] = reflect.TypeOf(PollEndEventContent{})
+}
+
+const (
+	pollKindDisclosed   = "org.matrix.msc3381.poll.disclosed"
+	pollKindUndisclosed = "org.matrix.msc3381.poll.undisclosed"
+)
+
+const (
+	minPollAnswers    = 2
+	maxPollAnswers    = 10
+	maxPollTextLength = 160
+	defaultPollExpiry = 7 * 24 * time.Hour
+)
+
+const groupMePollAttachment = "poll"
+
+type PollText struct {
+	Text string `json:"org.matrix.msc1767.text"`
+}
+
+type PollAnswer struct {
+	ID   string `json:"id"`
+	Text string `json:"org.matrix.msc1767.text"`
+}
+
+type PollStart struct {
+	Question      PollText     `json:"question"`
+	Kind          string       `json:"kind"`
+	MaxSelections int          `json:"max_selections"`
+	Answers       []PollAnswer `json:"answers"`
+}
+
+type PollStartEventContent struct {
+	PollStart PollStart `json:"org.matrix.msc3381.poll.start"`
+	Text      string    `json:"org.matrix.msc1767.text,omitempty"`
+}
+
+type PollResponse struct {
+	Answers []string `json:"answers"`
+}
+
+type PollResponseEventContent struct {
+	PollResponse PollResponse     `json:"org.matrix.msc3381.poll.response"`
+	RelatesTo    *event.RelatesTo `json:"m.relates_to,omitempty"`
+}
+
+type PollEndEventContent struct {
+	PollEnd   struct{}         `json:"org.matrix.msc3381.poll.end"`
+	Text      string           `json:"org.matrix.msc1767.text,omitempty"`
+	RelatesTo *event.RelatesTo `json:"m.relates_to,omitempty"`
+}
+
+func convertGroupMePoll(poll *groupmeext.Poll) *PollStartEventContent {
+	content := &PollStartEventContent{
+		PollStart: PollStart{
+			Question:      PollText{Text: poll.Subject},
+			Kind:          pollKindDisclosed,
+			MaxSelections: 1,
+			Answers:       make([]PollAnswer, len(poll.Options)),
+		},
+	}
+	if poll.Type == groupmeext.PollTypeMulti {
+		content.PollStart.MaxSelections = len(poll.Options)
+	}
+	fallback := []string{poll.Subject}
+	for i, option := range poll.Options {
+		content.PollStart.Answers[i] = PollAnswer{ID: option.ID, Text: option.Title}
+		fallback = append(fallback, fmt.Sprintf("%d. %s", i+1, option.Title))
+	}
+	content.Text = strings.Join(fallback, "\n")
+	return content
+}
+
+// handleGroupMePoll bridges the poll attached to a GroupMe message. groupme-lib
+// doesn't decode the poll ID of the attachment, so the message is refetched.
+func (portal *Portal) handleGroupMePoll(intent *appservice.IntentAPI, source *User, message *groupme.Message) (id.EventID, error) {
+	if portal.IsPrivateChat() {
+		return "", fmt.Errorf("polls are not supported in private chats")
+	}
+	details, err := source.Client.GetMessageDetails(context.TODO(), portal.Key.GMID, message.ID)
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch message details: %w", err)
+	}
+	attachment := details.GetAttachment(groupMePollAttachment)
+	if attachment == nil || len(attachment.PollID) == 0 {
+		return "", fmt.Errorf("message has no poll ID")
+	}
+	dbPoll, err := portal.startGroupMePoll(intent, source, attachment.PollID, message.CreatedAt.ToTime())
+	if err != nil {
+		return "", err
+	}
+	return dbPoll.MXID, nil
+}
+
+// startGroupMePoll sends the Matrix poll start event of a GroupMe poll, unless
+// the poll has been bridged already.
+func (portal *Portal) startGroupMePoll(intent *appservice.IntentAPI, source *User, pollID groupme.ID, ts time.Time) (*database.Poll, error) {
+	// Polls created on Matrix are inserted while holding the lock, so that
+	// the GroupMe message of the poll isn't bridged back to Matrix.
+	portal.pollLock.Lock()
+	defer portal.pollLock.Unlock()
+	if dbPoll := portal.bridge.DB.Poll.GetByPollID(portal.Key, pollID); dbPoll != nil {
+		return dbPoll, nil
+	}
+	poll, err := source.Client.GetPoll(context.TODO(), portal.Key.GMID, pollID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch poll %s: %w", pollID, err)
+	}
+	if intent == nil {
+		intent = portal.getReactionIntent(poll.OwnerID)
+	}
+	resp, err := portal.sendEvent(intent, EventPollStart, convertGroupMePoll(poll), nil, ts.UnixMilli())
+	if err != nil {
+		return nil, fmt.Errorf("failed to send poll start: %w", err)
+	}
+	dbPoll := portal.bridge.DB.Poll.New()
+	dbPoll.Chat = portal.Key
+	dbPoll.PollID = pollID
+	dbPoll.MXID = resp.EventID
+	dbPoll.Owner = poll.OwnerID
+	dbPoll.Insert()
+	portal.syncPollVotes(dbPoll, poll)
+	return dbPoll, nil
+}
+
+// resyncPoll bridges the current votes in a GroupMe poll and ends the Matrix
+// poll if the GroupMe poll has finished.
+func (portal *Portal) resyncPoll(source *User, pollID groupme.ID) {
+	if !source.IsLoggedIn() || portal.IsPrivateChat() {
+		return
+	}
+	dbPoll := portal.bridge.DB.Poll.GetByPollID(portal.Key, pollID)
+	if dbPoll == nil {
+		_, err := portal.startGroupMePoll(nil, source, pollID, time.Now())
+		if err != nil {
+			portal.log.Errorfln("Failed to bridge poll %s: %v", pollID, err)
+		}
+		return
+	} else if dbPoll.Ended {
+		return
+	}
+	poll, err := source.Client.GetPoll(context.TODO(), portal.Key.GMID, pollID)
+	if err != nil {
+		portal.log.Warnfln("Failed to fetch poll %s: %v", pollID, err)
+		return
+	}
+	portal.syncPollVotes(dbPoll, poll)
+}
+
+// syncPollVotes diffs the votes in a GroupMe poll against the bridged votes
+// and sends poll responses for every voter whose answers changed. Voters are
+// only known in public polls.
+func (portal *Portal) syncPollVotes(dbPoll *database.Poll, poll *groupmeext.Poll) {
+	votes := make(map[groupme.ID][]string)
+	for _, option := range poll.Options {
+		for _, voter := range option.VoterIDs {
+			votes[voter] = append(votes[voter], option.ID)
+		}
+	}
+	bridgedVotes := dbPoll.GetVotes()
+	for voter, bridged := range bridgedVotes {
+		if _, ok := votes[voter]; !ok && len(bridged.Answers) > 0 {
+			// An empty response removes the vote of the user.
+			votes[voter] = []string{}
+		}
+	}
+	for voter, answers := range votes {
+		sort.Strings(answers)
+		if bridged, ok := bridgedVotes[voter]; ok && strings.Join(bridged.Answers, ",") == strings.Join(answers, ",") {
+			continue
+		}
+		answerIDs := make([]string, len(answers))
+		for i, optionID := range answers {
+			answerIDs[i] = dbPoll.GetAnswerID(optionID)
+		}
+		resp, err := portal.sendEvent(portal.getReactionIntent(voter), EventPollResponse, &PollResponseEventContent{
+			PollResponse: PollResponse{Answers: answerIDs},
+			RelatesTo:    &event.RelatesTo{Type: event.RelReference, EventID: dbPoll.MXID},
+		}, nil, 0)
+		if err != nil {
+			portal.log.Errorfln("Failed to bridge vote of %s in poll %s: %v", voter, poll.ID, err)
+			continue
+		}
+		dbPoll.UpsertVote(&database.PollVote{Voter: voter, Answers: answers, MXID: resp.EventID})
+	}
+
+	if !poll.IsActive() {
+		portal.endPoll(dbPoll, poll)
+	}
+}
+
+func (portal *Portal) endPoll(dbPoll *database.Poll, poll *groupmeext.Poll) {
+	content := &PollEndEventContent{
+		Text:      "The poll has ended.",
+		RelatesTo: &event.RelatesTo{Type: event.RelReference, EventID: dbPoll.MXID},
+	}
+	var top *groupmeext.PollOption
+	for _, option := range poll.Options {
+		if option.Votes > 0 && (top == nil || option.Votes > top.Votes) {
+			top = option
+		}
+	}
+	if top != nil {
+		content.Text = fmt.Sprintf("The poll has ended. Top answer: %s", top.Title)
+	}
+	// Only the creator of the poll (or a moderator) can end it on Matrix.
+	_, err := portal.sendEvent(portal.getReactionIntent(dbPoll.Owner), EventPollEnd, content, nil, 0)
+	if err != nil {
+		portal.log.Warnfln("Failed to end poll %s as its creator, trying with main intent: %v", poll.ID, err)
+		_, err = portal.sendEvent(portal.MainIntent(), EventPollEnd, content, nil, 0)
+	}
+	if err != nil {
+		portal.log.Errorfln("Failed to end poll %s: %v", poll.ID, err)
+		return
+	}
+	dbPoll.Ended = true
+	dbPoll.Update()
+}
+
+// resyncOpenPolls queues a resync of all polls in the portal that are still
+// open, to pick up votes that there are no push events for.
+func (portal *Portal) resyncOpenPolls(source *User) {
+	if len(portal.MXID) == 0 {
+		return
+	}
+	for _, dbPoll := range portal.bridge.DB.Poll.GetOpenInChat(portal.Key) {
+		portal.messages <- PortalMessage{
+			chat:   portal.Key,
+			source: source,
+			data:   &groupme.Message{},
+			pollID: dbPoll.PollID,
+		}
+	}
+}
+
+// convertMatrixPoll converts a Matrix poll into a GroupMe poll. Matrix polls
+// don't have an expiry, so the one from the config is used.
+func (portal *Portal) convertMatrixPoll(content *PollStart) (*groupmeext.PollCreate, error) {
+	if len(content.Answers) < minPollAnswers {
+		return nil, fmt.Errorf("%w (%d, at least %d are needed)", errPollTooFewAnswers, len(content.Answers), minPollAnswers)
+	} else if len(content.Answers) > maxPollAnswers {
+		return nil, fmt.Errorf("%w (%d, at most %d are allowed)", errPollTooManyAnswers, len(content.Answers), maxPollAnswers)
+	} else if utf8.RuneCountInString(content.Question.Text) > maxPollTextLength {
+		return nil, fmt.Errorf("%w (the question can be at most %d characters)", errPollTextTooLong, maxPollTextLength)
+	}
+	expiry := portal.bridge.Config.Bridge.PollExpiry
+	if expiry <= 0 {
+		expiry = defaultPollExpiry
+	}
+	create := &groupmeext.PollCreate{
+		Subject:    content.Question.Text,
+		Options:    make([]*groupmeext.PollOption, len(content.Answers)),
+		Expiration: time.Now().Add(expiry).Unix(),
+		Type:       groupmeext.PollTypeSingle,
+		Visibility: groupmeext.PollVisibilityPublic,
+	}
+	if content.MaxSelections > 1 {
+		create.Type = groupmeext.PollTypeMulti
+	}
+	if content.Kind == pollKindUndisclosed {
+		create.Visibility = groupmeext.PollVisibilityAnonymous
+	}
+	for i, answer := range content.Answers {
+		if utf8.RuneCountInString(answer.Text) > maxPollTextLength {
+			return nil, fmt.Errorf("%w (answers can be at most %d characters)", errPollTextTooLong, maxPollTextLength)
+		}
+		create.Options[i] = &groupmeext.PollOption{Title: answer.Text}
+	}
+	return create, nil
+}
+
+// handleMatrixPollStart creates a GroupMe poll from a Matrix poll. It's called
+// from the outbox, so it may be retried for the same event.
+func (portal *Portal) handleMatrixPollStart(ctx context.Context, sender *User, evt *event.Event) error {
+	content, ok := evt.Content.Parsed.(*PollStartEventContent)
+	if !ok {
+		return fmt.Errorf("%w %T", errUnexpectedParsedContentType, evt.Content.Parsed)
+	} else if portal.IsPrivateChat() {
+		return errPollPrivateChat
+	} else if !sender.IsLoggedIn() {
+		if portal.GetRelayUser() != nil {
+			return errPollRelayUnsupported
+		}
+		return errUserNotLoggedIn
+	}
+	create, err := portal.convertMatrixPoll(&content.PollStart)
+	if err != nil {
+		return err
+	}
+
+	portal.pollLock.Lock()
+	defer portal.pollLock.Unlock()
+	if portal.bridge.DB.Poll.GetByMXID(evt.ID) != nil {
+		portal.log.Debugfln("Not creating poll for %s: it was already created", evt.ID)
+		return nil
+	}
+	poll, err := sender.Client.CreatePoll(ctx, portal.Key.GMID, create)
+	if err != nil {
+		return wrapGroupMeError(err)
+	} else if len(poll.Options) != len(content.PollStart.Answers) {
+		return fmt.Errorf("GroupMe returned %d options for %d answers", len(poll.Options), len(content.PollStart.Answers))
+	}
+	dbPoll := portal.bridge.DB.Poll.New()
+	dbPoll.Chat = portal.Key
+	dbPoll.PollID = poll.ID
+	dbPoll.MXID = evt.ID
+	dbPoll.Owner = sender.GMID
+	dbPoll.AnswerIDs = make(map[string]string, len(poll.Options))
+	for i, answer := range content.PollStart.Answers {
+		dbPoll.AnswerIDs[answer.ID] = poll.Options[i].ID
+	}
+	dbPoll.Insert()
+	portal.log.Debugfln("Created GroupMe poll %s for %s", poll.ID, evt.ID)
+	return nil
+}
+
+// handleMatrixPollResponse votes in a GroupMe poll. GroupMe can't take votes
+// back, so responses that remove answers are rejected.
+func (portal *Portal) handleMatrixPollResponse(ctx context.Context, sender *User, evt *event.Event) error {
+	if !sender.IsLoggedIn() {
+		return errUserNotLoggedIn
+	}
+	content, ok := evt.Content.Parsed.(*PollResponseEventContent)
+	if !ok {
+		return fmt.Errorf("%w %T", errUnexpectedParsedContentType, evt.Content.Parsed)
+	} else if content.RelatesTo == nil {
+		return fmt.Errorf("%w: poll response has no relation", errTargetNotFound)
+	}
+	dbPoll := portal.bridge.DB.Poll.GetByMXID(content.RelatesTo.EventID)
+	if dbPoll == nil || dbPoll.Chat != portal.Key {
+		return fmt.Errorf("%w %s", errTargetNotFound, content.RelatesTo.EventID)
+	} else if dbPoll.Ended {
+		return errPollEnded
+	}
+	var previous []string
+	if vote := dbPoll.GetVotes()[sender.GMID]; vote != nil {
+		if vote.MXID == evt.ID {
+			return nil
+		}
+		previous = vote.Answers
+	}
+
+	var optionIDs []string
+	seen := make(map[string]bool)
+	for _, answer := range content.PollResponse.Answers {
+		optionID, ok := dbPoll.GetOptionID(answer)
+		if !ok {
+			return fmt.Errorf("%w %q", errPollUnknownAnswer, answer)
+		} else if !seen[optionID] {
+			seen[optionID] = true
+			optionIDs = append(optionIDs, optionID)
+		}
+	}
+	if len(optionIDs) == 0 {
+		return errPollVoteRetract
+	}
+
+	poll, err := sender.Client.GetPoll(ctx, portal.Key.GMID, dbPoll.PollID)
+	if err != nil {
+		return wrapGroupMeError(err)
+	} else if !poll.IsActive() {
+		return errPollEnded
+	}
+	alreadyVoted := make(map[string]bool)
+	if poll.Type == groupmeext.PollTypeMulti {
+		for _, optionID := range previous {
+			if !seen[optionID] {
+				return errPollVoteRetract
+			}
+			alreadyVoted[optionID] = true
+		}
+	} else if len(optionIDs) > 1 {
+		// Only the first answer counts if there are more than the poll allows.
+		optionIDs = optionIDs[:1]
+	}
+	for _, optionID := range optionIDs {
+		if alreadyVoted[optionID] {
+			continue
+		}
+		err = sender.Client.Vote(ctx, portal.Key.GMID, dbPoll.PollID, optionID)
+		if err != nil {
+			return wrapGroupMeError(err)
+		}
+	}
+	sort.Strings(optionIDs)
+	dbPoll.UpsertVote(&database.PollVote{Voter: sender.GMID, Answers: optionIDs, MXID: evt.ID})
+	return nil
+}
@@ -21,6 +21,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"html"
 	"image"
 	"math"
 	"net/http"
@@ -37,6 +38,7 @@ import (
 	"maunium.net/go/mautrix/crypto/attachment"
 
 	"github.com/gabriel-vasile/mimetype"
+	"github.com/google/uuid"
 
 	"github.com/beeper/groupme-lib"
 
@@ -44,6 +46,7 @@ import (
 	"maunium.net/go/mautrix/appservice"
 	"maunium.net/go/mautrix/event"
 	"maunium.net/go/mautrix/id"
+	"maunium.net/go/mautrix/util/variationselector"
 
 	"github.com/beeper/groupme/database"
 	"github.com/beeper/groupme/groupmeext"
@@ -77,7 +80,7 @@ func (portal *Portal) MarkEncrypted() {
 }
 
 func (portal *Portal) ReceiveMatrixEvent(user bridge.User, evt *event.Event) {
-	if user.GetPermissionLevel() >= bridgeconfig.PermissionLevelUser {
+	if user.GetPermissionLevel() >= bridgeconfig.PermissionLevelUser || portal.HasRelaybot() {
 		portal.matrixMessages <- PortalMatrixMessage{user: user.(*User), evt: evt, receivedAt: time.Now()}
 	}
 }
@@ -155,10 +158,15 @@ func (bridge *GMBridge) NewManualPortal(key database.PortalKey) *Portal {
 
 		recentlyHandled: make([]string, recentlyHandledLength),
 
-		messages: make(chan PortalMessage, bridge.Config.Bridge.PortalMessageBuffer),
+		messages:       make(chan PortalMessage, bridge.Config.Bridge.PortalMessageBuffer),
+		matrixMessages: make(chan PortalMatrixMessage, bridge.Config.Bridge.PortalMessageBuffer),
+		outboxWake:     make(chan struct{}, 1),
+		outboxEvents:   make(map[id.EventID]*event.Event),
 	}
 	portal.Key = key
 	go portal.handleMessageLoop()
+	go portal.handleMatrixMessageLoop()
+	go portal.handleOutboxLoop()
 	return portal
 }
 
@@ -170,9 +178,14 @@ func (bridge *GMBridge) NewPortal(dbPortal *database.Portal) *Portal {
 
 		recentlyHandled: make([]string, recentlyHandledLength),
 
-		messages: make(chan PortalMessage, bridge.Config.Bridge.PortalMessageBuffer),
+		messages:       make(chan PortalMessage, bridge.Config.Bridge.PortalMessageBuffer),
+		matrixMessages: make(chan PortalMatrixMessage, bridge.Config.Bridge.PortalMessageBuffer),
+		outboxWake:     make(chan struct{}, 1),
+		outboxEvents:   make(map[id.EventID]*event.Event),
 	}
 	go portal.handleMessageLoop()
+	go portal.handleMatrixMessageLoop()
+	go portal.handleOutboxLoop()
 	return portal
 }
 
@@ -183,6 +196,15 @@ type PortalMessage struct {
 	source    *User
 	data      *groupme.Message
 	timestamp uint64
+	// isLike is set for messages received because their likes changed.
+	isLike bool
+	// isDeletion is set when the message was deleted. Only the ID of the
+	// message is known then.
+	isDeletion bool
+	// pollID is set when a poll should be resynced instead of handling a message.
+	pollID groupme.ID
+	// calendarEventID is set when a calendar event should be resynced.
+	calendarEventID string
 }
 
 type PortalMatrixMessage struct {
@@ -191,6 +213,12 @@ type PortalMatrixMessage struct {
 	receivedAt time.Time
 }
 
+var (
+	_ bridge.Portal                   = (*Portal)(nil)
+	_ bridge.MembershipHandlingPortal = (*Portal)(nil)
+	_ bridge.MetaHandlingPortal       = (*Portal)(nil)
+)
+
 type Portal struct {
 	*database.Portal
 
@@ -204,6 +232,8 @@ type Portal struct {
 	recentlyHandledIndex uint8
 
 	encryptLock   sync.Mutex
+	pollLock      sync.Mutex
+	likeIconLock  sync.RWMutex
 	backfilling   bool
 	lastMessageTs uint64
 
@@ -211,8 +241,14 @@ type Portal struct {
 
 	messages       chan PortalMessage
 	matrixMessages chan PortalMatrixMessage
+	outboxWake     chan struct{}
+	outboxLock     sync.Mutex
+	outboxEvents   map[id.EventID]*event.Event
+	outboxSending  id.EventID
+
+	relayUser *User
 
-	hasRelaybot *bool
+	publishedEmojiPacks map[int]bool
 }
 
 const MaxMessageAgeToCreatePortal = 5 * 60 // 5 minutes
@@ -235,13 +271,84 @@ func (portal *Portal) handleMessageLoop() {
 	}
 }
 
+// handleMatrixMessageLoop handles the Matrix events of the portal one at a
+// time, so that they're bridged in the order they were sent in.
+func (portal *Portal) handleMatrixMessageLoop() {
+	for msg := range portal.matrixMessages {
+		portal.handleMatrixMessageLoopItem(msg)
+	}
+}
+
+func (portal *Portal) handleMatrixMessageLoopItem(msg PortalMatrixMessage) {
+	switch msg.evt.Type {
+	// Reactions and poll votes go through the outbox like messages, so that
+	// they're only sent after the messages they target.
+	case event.EventMessage, event.EventSticker, EventPollStart, event.EventReaction, EventPollResponse:
+		portal.HandleMatrixMessage(msg.user, msg.evt)
+	case event.EventRedaction:
+		portal.HandleMatrixRedaction(msg.user, msg.evt)
+	case event.StateRoomName, event.StateTopic, event.StateRoomAvatar:
+		ctx, cancel := portal.getMatrixHandlingContext()
+		portal.handleMatrixMeta(ctx, msg.user, msg.evt)
+		cancel()
+	default:
+		portal.log.Warnfln("Unsupported event type %s in portal message channel", msg.evt.Type)
+	}
+}
+
 func (portal *Portal) handleMessage(msg PortalMessage) {
 	if len(portal.MXID) == 0 {
 		portal.log.Warnln("handleMessage called even though portal.MXID is empty")
 		return
 	}
+	if msg.isDeletion {
+		portal.handleDeletion(msg.data.ID)
+		return
+	} else if len(msg.pollID) > 0 {
+		portal.resyncPoll(msg.source, msg.pollID)
+		return
+	} else if len(msg.calendarEventID) > 0 {
+		portal.resyncCalendarEvent(msg.source, msg.calendarEventID)
+		return
+	}
 	portal.HandleTextMessage(msg.source, msg.data)
-	// portal.handleReaction(msg.data.ID.String(), msg.data.FavoritedBy)
+	portal.handleReactions(msg.source, msg.data, msg.isLike)
+}
+
+// handleDeletion redacts the Matrix events of a message that was deleted on
+// GroupMe. The events are redacted by the sender of the message if possible.
+func (portal *Portal) handleDeletion(messageID groupme.ID) {
+	parts := portal.bridge.DB.Message.GetAllByGMID(portal.Key, messageID)
+	if len(parts) == 0 {
+		portal.log.Debugfln("Ignoring deletion of unknown message %s", messageID)
+		return
+	}
+	intent := portal.MainIntent()
+	if len(parts[0].Sender) > 0 {
+		intent = portal.bridge.GetPuppetByGMID(parts[0].Sender).IntentFor(portal)
+	}
+	redactedAll := true
+	for _, msg := range parts {
+		if len(msg.MXID) == 0 {
+			continue
+		}
+		_, err := intent.RedactEvent(portal.MXID, msg.MXID)
+		if err != nil && intent != portal.MainIntent() {
+			portal.log.Warnfln("Failed to redact %s as %s, trying with main intent: %v", msg.MXID, msg.Sender, err)
+			_, err = portal.MainIntent().RedactEvent(portal.MXID, msg.MXID)
+		}
+		if err != nil {
+			portal.log.Errorfln("Failed to redact %s after %s was deleted: %v", msg.MXID, messageID, err)
+			redactedAll = false
+			continue
+		}
+		portal.log.Debugfln("Redacted %s after %s was deleted", msg.MXID, messageID)
+	}
+	// The message is kept if some part couldn't be redacted, so that the
+	// deletion is retried if it's detected again.
+	if redactedAll {
+		parts[0].Delete()
+	}
 }
 
 func (portal *Portal) isRecentlyHandled(id groupme.ID) bool {
@@ -266,11 +373,12 @@ func (portal *Portal) isDuplicate(id groupme.ID) bool {
 func init() {
 }
 
-func (portal *Portal) markHandled(source *User, message *groupme.Message, mxid id.EventID) {
+func (portal *Portal) markHandled(source *User, message *groupme.Message, mxid id.EventID, part int) {
 	msg := portal.bridge.DB.Message.New()
 	msg.Chat = portal.Key
 	msg.GMID = message.ID
 	msg.MXID = mxid
+	msg.Part = part
 	msg.Timestamp = message.CreatedAt.ToTime()
 	if message.UserID == source.GMID {
 		msg.Sender = source.GMID
@@ -279,15 +387,52 @@ func (portal *Portal) markHandled(source *User, message *groupme.Message, mxid i
 	} else {
 		msg.Sender = message.SenderID
 	}
-	// msg.Insert()
+	msg.Sent = true
+	msg.Insert(nil)
+}
+
+// markPending stores a message that is about to be sent to GroupMe, so that
+// the echo can be recognized by its source GUID even if it arrives before
+// the send request returns.
+func (portal *Portal) markPending(source *User, message *groupme.Message, mxid id.EventID, part int) *database.Message {
+	msg := portal.bridge.DB.Message.New()
+	msg.Chat = portal.Key
+	// The real ID isn't known yet, but the source GUID is unique as well.
+	msg.GMID = groupme.ID(message.SourceGUID)
+	msg.MXID = mxid
+	msg.Part = part
+	msg.Sender = source.GMID
+	msg.Timestamp = time.Now()
+	msg.SourceGUID = message.SourceGUID
+	msg.Insert(nil)
+	return msg
+}
 
+func (portal *Portal) addRecentlyHandled(id groupme.ID) {
 	portal.recentlyHandledLock.Lock()
 	portal.recentlyHandled[0] = "" //FIFO queue being implemented here //TODO: is this efficent
 	portal.recentlyHandled = portal.recentlyHandled[1:]
-	portal.recentlyHandled = append(portal.recentlyHandled, message.ID.String())
+	portal.recentlyHandled = append(portal.recentlyHandled, id.String())
 	portal.recentlyHandledLock.Unlock()
 }
 
+// isOwnEcho checks if a message from GroupMe is one that was sent from Matrix
+// by looking up its source GUID. Echoes of messages that are still pending
+// are used to store the real message ID.
+func (portal *Portal) isOwnEcho(info *groupme.Message) bool {
+	if len(info.SourceGUID) == 0 {
+		return false
+	}
+	msg := portal.bridge.DB.Message.GetBySourceGUID(portal.Key, info.SourceGUID)
+	if msg == nil {
+		return false
+	} else if !msg.Sent {
+		msg.MarkSent(info.ID, info.CreatedAt.ToTime())
+		portal.addRecentlyHandled(info.ID)
+	}
+	return true
+}
+
 func (portal *Portal) getMessageIntent(user *User, info *groupme.Message) *appservice.IntentAPI {
 	if portal.IsPrivateChat() {
 		if info.UserID == user.GetGMID() { //from me
@@ -312,13 +457,21 @@ func (portal *Portal) startHandling(source *User, info *groupme.Message) *appser
 		portal.log.Debugfln("Not handling %s: message is older (%d) than last bridge message (%d)", info.ID, info.CreatedAt, portal.lastMessageTs)
 	} else if portal.isRecentlyHandled(info.ID) {
 		portal.log.Debugfln("Not handling %s: message was recently handled", info.ID)
+	} else if portal.isOwnEcho(info) {
+		portal.log.Debugfln("Not handling %s: message is an echo of a message sent from Matrix", info.ID)
 	} else if portal.isDuplicate(info.ID) {
 		portal.log.Debugfln("Not handling %s: message is duplicate", info.ID)
-	} else if info.System {
+	} else if info.System && !hasCalendarEventAttachment(info) {
 		portal.log.Debugfln("Not handling %s: message is from system: %s", info.ID, info.Text)
 	} else {
 		portal.lastMessageTs = uint64(info.CreatedAt.ToTime().Unix())
-		intent := portal.getMessageIntent(source, info)
+		var intent *appservice.IntentAPI
+		if info.System {
+			// Calendar events are sent by their creator rather than the system user.
+			intent = portal.MainIntent()
+		} else {
+			intent = portal.getMessageIntent(source, info)
+		}
 		if intent != nil {
 			portal.log.Debugfln("Starting handling of %s (ts: %d)", info.ID, info.CreatedAt)
 		} else {
@@ -329,10 +482,22 @@ func (portal *Portal) startHandling(source *User, info *groupme.Message) *appser
 	return nil
 }
 
-func (portal *Portal) finishHandling(source *User, message *groupme.Message, mxid id.EventID) {
-	portal.markHandled(source, message, mxid)
-	portal.sendDeliveryReceipt(mxid)
-	portal.log.Debugln("Handled message", message.ID.String(), "->", mxid)
+// finishHandling stores the Matrix events that a GroupMe message was bridged
+// as. The last event, usually the text, is stored as the main part that
+// replies and reactions target, and the others as the following parts.
+func (portal *Portal) finishHandling(source *User, message *groupme.Message, mxids []id.EventID) {
+	var mainID id.EventID
+	if len(mxids) > 0 {
+		mainID = mxids[len(mxids)-1]
+		mxids = mxids[:len(mxids)-1]
+	}
+	portal.markHandled(source, message, mainID, 0)
+	for i, mxid := range mxids {
+		portal.markHandled(source, message, mxid, i+1)
+	}
+	portal.addRecentlyHandled(message.ID)
+	portal.sendDeliveryReceipt(mainID)
+	portal.log.Debugln("Handled message", message.ID.String(), "->", mainID)
 }
 
 func (portal *Portal) SyncParticipants(metadata *groupme.Group) {
@@ -345,10 +510,14 @@ func (portal *Portal) SyncParticipants(metadata *groupme.Group) {
 	participantMap := make(map[groupme.ID]bool)
 	for _, participant := range metadata.Members {
 		participantMap[participant.UserID] = true
+		puppet := portal.bridge.GetPuppetByGMID(participant.UserID)
+		if portal.bridge.StateStore.IsMembership(portal.MXID, puppet.MXID, event.MembershipBan) {
+			portal.log.Debugfln("Not syncing %s: puppet is banned from the room", participant.UserID)
+			continue
+		}
 		user := portal.bridge.GetUserByGMID(participant.UserID)
 		portal.userMXIDAction(user, portal.ensureMXIDInvited)
 
-		puppet := portal.bridge.GetPuppetByGMID(participant.UserID)
 		err := puppet.IntentFor(portal).EnsureJoined(portal.MXID)
 		if err != nil {
 			portal.log.Warnfln("Failed to make puppet of %s join %s: %v", participant.ID.String(), portal.MXID, err)
@@ -491,11 +660,61 @@ func (portal *Portal) UpdateTopic(topic string, setBy groupme.ID, updateInfo boo
 	return false
 }
 
+// UpdateLikeIcon stores the custom like icon of the group, which is used as
+// the reaction key of likes bridged after this. It's called from the push
+// and sync goroutines, so the icon is guarded by likeIconLock.
+func (portal *Portal) UpdateLikeIcon(iconType string, packID, packIndex int) {
+	portal.likeIconLock.Lock()
+	defer portal.likeIconLock.Unlock()
+	if portal.LikeIconType == iconType && portal.LikeIconPackID == packID && portal.LikeIconPackIndex == packIndex {
+		return
+	}
+	portal.log.Debugfln("Like icon changed to %q (pack %d, index %d)", iconType, packID, packIndex)
+	portal.LikeIconType = iconType
+	portal.LikeIconPackID = packID
+	portal.LikeIconPackIndex = packIndex
+	portal.Update(nil)
+}
+
+func (portal *Portal) getLikeIcon() (iconType string, packID, packIndex int) {
+	portal.likeIconLock.RLock()
+	defer portal.likeIconLock.RUnlock()
+	return portal.LikeIconType, portal.LikeIconPackID, portal.LikeIconPackIndex
+}
+
+// likeReactionKey returns the reaction key that GroupMe likes are bridged as.
+// Likes in groups with a custom like icon use the mxc URI of the pack emoji,
+// so that clients can render it, or its shortcode if it isn't uploaded yet.
+func (portal *Portal) likeReactionKey() string {
+	iconType, packID, packIndex := portal.getLikeIcon()
+	if iconType != "emoji" {
+		return groupMeLikeEmoji
+	} else if emoji := portal.getPowerupEmoji(packID, packIndex); emoji != nil {
+		return string(emoji.MXC)
+	}
+	return ":" + powerupShortcode(packID, packIndex) + ":"
+}
+
+// isLikeReactionKey returns whether a Matrix reaction should be sent to
+// GroupMe as a plain like.
+func (portal *Portal) isLikeReactionKey(key string) bool {
+	iconType, packID, packIndex := portal.getLikeIcon()
+	if groupMeLikeEmojis[key] {
+		return true
+	} else if iconType != "emoji" {
+		return false
+	} else if key == ":"+powerupShortcode(packID, packIndex)+":" {
+		return true
+	}
+	emoji := portal.bridge.DB.Emoji.GetByMXC(id.ContentURIString(key))
+	return emoji != nil && emoji.PackID == packID && emoji.PackIndex == packIndex
+}
+
 func (portal *Portal) UpdateMetadata(user *User) bool {
 	if portal.IsPrivateChat() {
 		return false
 	}
-	group, err := user.Client.ShowGroup(context.TODO(), groupme.ID(strings.Replace(portal.Key.GMID.String(), groupmeext.NewUserSuffix, "", 1)))
+	group, likeIcon, err := user.Client.ShowGroupWithLikeIcon(context.TODO(), groupme.ID(strings.Replace(portal.Key.GMID.String(), groupmeext.NewUserSuffix, "", 1)))
 	if err != nil {
 		portal.log.Errorln(err)
 		return false
@@ -514,6 +733,11 @@ func (portal *Portal) UpdateMetadata(user *User) bool {
 	update := false
 	update = portal.UpdateName(group.Name, "", false) || update
 	update = portal.UpdateTopic(group.Description, "", false) || update
+	if likeIcon != nil {
+		portal.UpdateLikeIcon(likeIcon.Type, likeIcon.PackID, likeIcon.PackIndex)
+	} else {
+		portal.UpdateLikeIcon("", 0, 0)
+	}
 
 	//	portal.RestrictMessageSending(metadata.Announce)
 
@@ -562,6 +786,7 @@ func (portal *Portal) Sync(user *User, group *groupme.Group) {
 		}
 	} else {
 		portal.ensureUserInvited(user)
+		portal.syncDeletions(user)
 	}
 
 	if portal.IsPrivateChat() {
@@ -571,6 +796,7 @@ func (portal *Portal) Sync(user *User, group *groupme.Group) {
 	update := false
 	update = portal.UpdateMetadata(user) || update
 	update = portal.UpdateAvatar(user, group.ImageURL, false) || update
+	portal.resyncOpenPolls(user)
 
 	if update {
 		portal.Update(nil)
@@ -578,6 +804,41 @@ func (portal *Portal) Sync(user *User, group *groupme.Group) {
 	}
 }
 
+// syncDeletions finds the recent messages that were deleted on GroupMe while
+// the bridge wasn't connected, and queues their deletion. Only the latest page
+// of messages is checked, so deletions of older messages are still missed.
+func (portal *Portal) syncDeletions(user *User) {
+	if !user.IsLoggedIn() {
+		return
+	}
+	messages, err := user.Client.LoadMessagesBefore(portal.Key.GMID.String(), "", portal.IsPrivateChat())
+	if err != nil {
+		portal.log.Warnln("Failed to fetch recent messages to check for deletions:", err)
+		return
+	} else if len(messages) == 0 {
+		return
+	}
+	existing := make(map[groupme.ID]bool, len(messages))
+	oldest, newest := messages[0].CreatedAt.ToTime(), messages[0].CreatedAt.ToTime()
+	for _, msg := range messages {
+		existing[msg.ID] = true
+		if ts := msg.CreatedAt.ToTime(); ts.Before(oldest) {
+			oldest = ts
+		} else if ts.After(newest) {
+			newest = ts
+		}
+	}
+	// Timestamps only have second precision, so messages from the same second
+	// as the newest one may just have been sent after the page was fetched.
+	for _, msg := range portal.bridge.DB.Message.GetMessagesBetween(portal.Key, oldest, newest.Add(-time.Second)) {
+		if !existing[msg.GMID] {
+			// Messages with several parts only need to be deleted once.
+			existing[msg.GMID] = true
+			user.HandleMessageDeleted(groupme.ID(portal.Key.String()), msg.GMID)
+		}
+	}
+}
+
 func (portal *Portal) GetBasePowerLevels() *event.PowerLevelsEventContent {
 	anyone := 0
 	nope := 99
@@ -842,6 +1103,22 @@ func (portal *Portal) IsPrivateChat() bool {
 	return portal.Key.IsPrivate()
 }
 
+func (portal *Portal) HasRelaybot() bool {
+	return portal.bridge.Config.Bridge.Relay.Enabled && len(portal.RelayUserID) > 0
+}
+
+func (portal *Portal) GetRelayUser() *User {
+	if !portal.HasRelaybot() {
+		return nil
+	} else if portal.relayUser == nil || portal.relayUser.MXID != portal.RelayUserID {
+		portal.relayUser = portal.bridge.GetUserByMXID(portal.RelayUserID)
+	}
+	if portal.relayUser == nil || !portal.relayUser.IsLoggedIn() {
+		return nil
+	}
+	return portal.relayUser
+}
+
 func (portal *Portal) IsStatusBroadcastRoom() bool {
 	return portal.Key.GMID == "status@broadcast"
 }
@@ -921,6 +1198,12 @@ func (portal *Portal) encrypt(intent *appservice.IntentAPI, content *event.Conte
 }
 
 func (portal *Portal) sendMessage(intent *appservice.IntentAPI, eventType event.Type, content *event.MessageEventContent, extraContent map[string]any, timestamp int64) (*mautrix.RespSendEvent, error) {
+	return portal.sendEvent(intent, eventType, content, extraContent, timestamp)
+}
+
+// sendEvent sends any kind of message event, for event types that don't use
+// a MessageEventContent.
+func (portal *Portal) sendEvent(intent *appservice.IntentAPI, eventType event.Type, content interface{}, extraContent map[string]any, timestamp int64) (*mautrix.RespSendEvent, error) {
 	wrappedContent := event.Content{Parsed: content, Raw: extraContent}
 	var err error
 	eventType, err = portal.encrypt(intent, &wrappedContent, eventType)
@@ -1106,13 +1389,12 @@ func (portal *Portal) handleAttachment(intent *appservice.IntentAPI, attachment
 
 		return content, false, nil
 	case "reply":
-		fmt.Printf("%+v\n", attachment)
-		content := &event.MessageEventContent{
-			Body:    message.Text,
-			MsgType: event.MsgText,
-		}
+		content := portal.convertGroupMeText(message)
 		portal.SetReply(content, attachment.ReplyID)
 		return content, false, nil
+	case groupme.Mentions, groupme.Emoji:
+		// Mentions and powerup emojis are rendered as part of the message text.
+		return nil, true, nil
 
 	default:
 		portal.log.Warnln("Unable to handle groupme attachment type", attachment.Type)
@@ -1128,13 +1410,34 @@ func (portal *Portal) HandleTextMessage(source *User, message *groupme.Message)
 	}
 
 	sendText := true
-	var sentID id.EventID
+	var sentIDs []id.EventID
 	for _, a := range message.Attachments {
+		if a.Type == groupMePollAttachment {
+			pollID, err := portal.handleGroupMePoll(intent, source, message)
+			if err != nil {
+				portal.log.Errorfln("Failed to bridge poll in %s: %v", message.ID, err)
+				continue
+			}
+			sentIDs = append(sentIDs, pollID)
+			sendText = false
+			continue
+		} else if a.Type == groupMeEventAttachment {
+			calendarEventID, err := portal.handleGroupMeCalendarEvent(source, message)
+			if err != nil {
+				portal.log.Errorfln("Failed to bridge calendar event in %s: %v", message.ID, err)
+				continue
+			}
+			sentIDs = append(sentIDs, calendarEventID)
+			sendText = false
+			continue
+		}
 		msg, text, err := portal.handleAttachment(intent, a, source, message)
 
 		if err != nil {
 			portal.log.Errorfln("Failed to handle message %s: %v", "TODOID", err)
-			portal.sendMediaBridgeFailure(source, intent, *message, err)
+			if failureID := portal.sendMediaBridgeFailure(intent, *message, err); len(failureID) > 0 {
+				sentIDs = append(sentIDs, failureID)
+			}
 			continue
 		}
 		if msg == nil {
@@ -1143,20 +1446,18 @@ func (portal *Portal) HandleTextMessage(source *User, message *groupme.Message)
 		resp, err := portal.sendMessage(intent, event.EventMessage, msg, nil, message.CreatedAt.ToTime().Unix())
 		if err != nil {
 			portal.log.Errorfln("Failed to handle message %s: %v", "TODOID", err)
-			portal.sendMediaBridgeFailure(source, intent, *message, err)
+			if failureID := portal.sendMediaBridgeFailure(intent, *message, err); len(failureID) > 0 {
+				sentIDs = append(sentIDs, failureID)
+			}
 			continue
 		}
-		sentID = resp.EventID
+		sentIDs = append(sentIDs, resp.EventID)
 
 		sendText = sendText && text
 	}
 
 	//	portal.SetReply(content, message.ContextInfo)
-	//TODO: mentions
-	content := &event.MessageEventContent{
-		Body:    message.Text,
-		MsgType: event.MsgText,
-	}
+	content := portal.convertGroupMeText(message)
 
 	_, _ = intent.UserTyping(portal.MXID, false, 0)
 	if sendText {
@@ -1165,96 +1466,121 @@ func (portal *Portal) HandleTextMessage(source *User, message *groupme.Message)
 			portal.log.Errorfln("Failed to handle message %s: %v", message.ID, err)
 			return
 		}
-		sentID = resp.EventID
-
-	}
-	portal.finishHandling(source, message, sentID)
-}
-
-// func (portal *Portal) handleReaction(msgID groupme.ID, ppl []groupme.ID) {
-// 	reactions := portal.bridge.DB.Reaction.GetByGMID(msgID)
-// 	newLikes := newReactions(reactions, ppl)
-// 	removeLikes := oldReactions(reactions, ppl)
-
-// 	var eventID id.EventID
-// 	if len(newLikes) > 0 {
-// 		message := portal.bridge.DB.Message.GetByGMID(portal.Key, msgID)
-// 		if message == nil {
-// 			portal.log.Errorln("Received reaction for unknown message", msgID)
-// 			return
-// 		}
-// 		eventID = message.MXID
-// 	}
-
-// 	for _, jid := range newLikes {
-// 		intent := portal.getReactionIntent(jid)
-// 		resp, err := portal.sendReaction(intent, eventID, "❤")
-// 		if err != nil {
-// 			portal.log.Errorln("Something wrong with sending reaction", msgID, jid, err)
-// 			continue
-// 		}
-
-// 		newReaction := portal.bridge.DB.Reaction.New()
-// 		newReaction.MXID = resp.EventID
-// 		newReaction.MessageJID = msgID
-// 		newReaction.MessageMXID = eventID
-// 		newReaction.PuppetJID = jid
-
-// 		newReaction.Insert()
-
-// 	}
-
-// 	for _, reaction := range removeLikes {
-// 		if len(reaction.Puppet.JID) == 0 {
-// 			portal.log.Warnln("Reaction user state wrong", reaction.MXID, msgID)
-// 			continue
-// 		}
-// 		intent := portal.getReactionIntent(reaction.PuppetJID)
-// 		_, err := intent.RedactEvent(portal.MXID, reaction.MXID)
-// 		if err != nil {
-// 			portal.log.Errorln("Something wrong with reaction redaction", reaction.MXID)
-// 			continue
-// 		}
-// 		reaction.Delete()
-
-// 	}
-// }
-
-// func oldReactions(a []*database.Reaction, b []string) (ans []*database.Reaction) {
-// 	for _, i := range a {
-// 		flag := false
-// 		for _, j := range b {
-// 			if i.PuppetJID == j {
-// 				flag = true
-// 				break
-// 			}
-// 		}
-// 		if !flag {
-// 			ans = append(ans, i)
-// 		}
-// 	}
-
-// 	return
-// }
-
-// func newReactions(a []*database.Reaction, b []string) (ans []string) {
-// 	for _, j := range b {
-// 		flag := false
-// 		for _, i := range a {
-// 			if i.GMID == j {
-// 				flag = true
-// 				break
-// 			}
-// 		}
-// 		if !flag {
-// 			ans = append(ans, j)
-// 		}
-// 	}
-
-// 	return
-// }
-
-func (portal *Portal) sendMediaBridgeFailure(source *User, intent *appservice.IntentAPI, message groupme.Message, bridgeErr error) {
+		sentIDs = append(sentIDs, resp.EventID)
+
+	}
+	portal.finishHandling(source, message, sentIDs)
+}
+
+// handleReactions syncs the likes and reactions of a GroupMe message to
+// Matrix. The users who liked the message are diffed against the reaction
+// table, so only new, changed and removed reactions are bridged.
+func (portal *Portal) handleReactions(source *User, message *groupme.Message, fetchLikes bool) {
+	target := portal.bridge.DB.Message.GetByGMID(portal.Key, message.ID)
+	if target == nil || !target.Sent {
+		return
+	}
+
+	// An empty emoji means the user liked the message, but the emoji they
+	// reacted with is unknown, as groupme-lib doesn't decode reactions.
+	likes := make(map[groupme.ID]string, len(message.FavoritedBy))
+	for _, userID := range message.FavoritedBy {
+		likes[groupme.ID(userID)] = ""
+	}
+	if fetchLikes && !portal.IsPrivateChat() && source.IsLoggedIn() {
+		details, err := source.Client.GetMessageDetails(context.TODO(), portal.Key.GMID, message.ID)
+		if err != nil {
+			portal.log.Warnfln("Failed to fetch reactions of %s: %v", message.ID, err)
+		} else {
+			likes = make(map[groupme.ID]string, len(details.FavoritedBy))
+			for _, userID := range details.FavoritedBy {
+				likes[userID] = ""
+			}
+			for _, reaction := range details.Reactions {
+				if reaction.Type != "unicode" || len(reaction.Code) == 0 {
+					continue
+				}
+				for _, userID := range reaction.UserIDs {
+					likes[userID] = variationselector.Remove(reaction.Code)
+				}
+			}
+		}
+	}
+
+	for _, reaction := range portal.bridge.DB.Reaction.GetAllByTargetGMID(portal.Key, message.ID) {
+		emoji, ok := likes[reaction.Sender]
+		if ok && (len(emoji) == 0 || emoji == reaction.Emoji) {
+			delete(likes, reaction.Sender)
+			continue
+		} else if len(portal.bridge.DB.Reaction.GetAllByMXID(reaction.MXID)) > 1 {
+			// The Matrix reaction is shared with other parts of the same
+			// Matrix message, which are still liked.
+			reaction.Delete()
+			continue
+		}
+		_, err := portal.getReactionIntent(reaction.Sender).RedactEvent(portal.MXID, reaction.MXID)
+		if err != nil {
+			portal.log.Warnfln("Failed to redact reaction %s by %s, trying with main intent: %v", reaction.MXID, reaction.Sender, err)
+			_, err = portal.MainIntent().RedactEvent(portal.MXID, reaction.MXID)
+		}
+		if err != nil {
+			portal.log.Errorfln("Failed to redact reaction %s: %v", reaction.MXID, err)
+			continue
+		}
+		reaction.Delete()
+	}
+
+	// Messages that were split into several GroupMe messages share one Matrix
+	// event, which only gets one reaction per user and emoji.
+	var siblings []*database.Message
+	for _, part := range portal.bridge.DB.Message.GetAllByMXID(target.MXID) {
+		if part.GMID != message.ID {
+			siblings = append(siblings, part)
+		}
+	}
+	var likeKey string
+	for userID, emoji := range likes {
+		if len(emoji) == 0 {
+			if len(likeKey) == 0 {
+				likeKey = portal.likeReactionKey()
+			}
+			emoji = likeKey
+		}
+		dbReaction := portal.bridge.DB.Reaction.New()
+		dbReaction.Chat = portal.Key
+		dbReaction.TargetGMID = message.ID
+		dbReaction.TargetPart = target.Part
+		dbReaction.Sender = userID
+		dbReaction.Emoji = emoji
+		if existing := portal.findSiblingReaction(siblings, userID, emoji); existing != nil {
+			dbReaction.MXID = existing.MXID
+		} else {
+			resp, err := portal.sendReaction(portal.getReactionIntent(userID), target.MXID, variationselector.FullyQualify(emoji))
+			if err != nil {
+				portal.log.Errorfln("Failed to bridge reaction to %s by %s: %v", message.ID, userID, err)
+				continue
+			}
+			dbReaction.MXID = resp.EventID
+		}
+		dbReaction.Upsert(nil)
+	}
+}
+
+// findSiblingReaction finds a reaction by the given user to another part of
+// the same Matrix message.
+func (portal *Portal) findSiblingReaction(siblings []*database.Message, userID groupme.ID, emoji string) *database.Reaction {
+	for _, sibling := range siblings {
+		reaction := portal.bridge.DB.Reaction.GetByTargetGMID(portal.Key, sibling.GMID, userID)
+		if reaction != nil && reaction.Emoji == emoji {
+			return reaction
+		}
+	}
+	return nil
+}
+
+// sendMediaBridgeFailure sends a notice in place of media that couldn't be
+// bridged and returns its event ID, which is stored as a part of the message.
+func (portal *Portal) sendMediaBridgeFailure(intent *appservice.IntentAPI, message groupme.Message, bridgeErr error) id.EventID {
 	portal.log.Errorfln("Failed to bridge media for %s: %v", message.UserID.String(), bridgeErr)
 	resp, err := portal.sendMessage(intent, event.EventMessage, &event.MessageEventContent{
 		MsgType: event.MsgNotice,
@@ -1262,9 +1588,9 @@ func (portal *Portal) sendMediaBridgeFailure(source *User, intent *appservice.In
 	}, nil, int64(message.CreatedAt.ToTime().Unix()*1000))
 	if err != nil {
 		portal.log.Errorfln("Failed to send media download error message for %s: %v", message.UserID.String(), err)
-	} else {
-		portal.finishHandling(source, &message, resp.EventID)
+		return ""
 	}
+	return resp.EventID
 }
 
 func (portal *Portal) encryptFile(data []byte, mimeType string) ([]byte, string, *event.EncryptedFileInfo) {
@@ -1308,11 +1634,10 @@ func (portal *Portal) removeUser(isSameUser bool, kicker *appservice.IntentAPI,
 	}
 }
 
-func (portal *Portal) convertMatrixMessage(sender *User, evt *event.Event) ([]*groupme.Message, *User) {
+func (portal *Portal) convertMatrixMessage(sender *User, evt *event.Event) ([]*groupme.Message, *User, error) {
 	content, ok := evt.Content.Parsed.(*event.MessageEventContent)
 	if !ok {
-		portal.log.Debugfln("Failed to handle event %s: unexpected parsed content type %T", evt.ID, evt.Content.Parsed)
-		return nil, sender
+		return nil, sender, fmt.Errorf("%w %T", errUnexpectedParsedContentType, evt.Content.Parsed)
 	}
 
 	//ts := uint64(evt.Timestamp / 1000)
@@ -1336,39 +1661,226 @@ func (portal *Portal) convertMatrixMessage(sender *User, evt *event.Event) ([]*g
 		RecipientID:    groupme.ID(portal.Key.GMID),
 	}
 	replyToID := content.GetReplyTo()
+	var replyQuote string
 	if len(replyToID) > 0 {
-		//		content.RemoveReplyFallback()
-		//		msg := portal.bridge.DB.Message.GetByMXID(replyToID)
-		//		if msg != nil && msg.Content != nil {
-		//			ctxInfo.StanzaId = &msg.JID
-		//			ctxInfo.Participant = &msg.Sender
-		//			ctxInfo.QuotedMessage = msg.Content
-		//		}
+		content.RemoveReplyFallback()
+		msg := portal.bridge.DB.Message.GetByMXID(replyToID)
+		if msg != nil && msg.Sent && len(msg.GMID) > 0 {
+			info.Attachments = append(info.Attachments, &groupme.Attachment{
+				Type:    groupmeext.ReplyAttachment,
+				ReplyID: msg.GMID,
+			})
+		} else {
+			replyQuote = portal.getReplyQuote(replyToID)
+		}
 	}
-	relaybotFormatted := false
 
+	// Stickers are sent as images.
 	if evt.Type == event.EventSticker {
 		content.MsgType = event.MsgImage
-	} else if content.MsgType == event.MsgImage && content.GetInfo().MimeType == "image/gif" {
-		content.MsgType = event.MsgVideo
 	}
 
+	relaybotFormatted := false
+	if !sender.IsLoggedIn() {
+		relayUser := portal.GetRelayUser()
+		if relayUser == nil {
+			if portal.HasRelaybot() {
+				return nil, sender, errRelaybotNotLoggedIn
+			}
+			return nil, sender, errUserNotLoggedIn
+		}
+		relaybotFormatted = portal.addRelaybotFormat(sender.MXID, content)
+		sender = relayUser
+	}
+
+	var emojiCharmap [][]int
+	if content.Format == event.FormatHTML {
+		content.FormattedBody, emojiCharmap = portal.replaceMatrixEmoticons(content.FormattedBody)
+	}
+
+	var mentions *groupme.Attachment
 	switch content.MsgType {
 	case event.MsgText, event.MsgEmote, event.MsgNotice:
-		text := content.Body
-		if content.Format == event.FormatHTML {
-			text = portal.parseMatrixHTML(content)
-		}
+		info.Text, mentions = portal.parseMatrixHTML(content)
 		if content.MsgType == event.MsgEmote && !relaybotFormatted {
-			text = "/me " + text
+			info.Text = prefixText("/me ", info.Text, mentions)
+		}
+	case event.MsgImage, event.MsgVideo, event.MsgAudio, event.MsgFile:
+		attachment, err := portal.uploadMatrixMedia(sender, info.ConversationID, content)
+		if err != nil {
+			return nil, sender, err
+		}
+		if relaybotFormatted || (content.FileName != "" && content.Body != content.FileName) {
+			info.Text, mentions = portal.parseMatrixHTML(content)
+		}
+		info.Attachments = append(info.Attachments, attachment)
+
+	default:
+		return nil, sender, fmt.Errorf("%w %q", errUnknownMsgType, content.MsgType)
+	}
+	if len(replyQuote) > 0 {
+		info.Text = prefixText(replyQuote, info.Text, mentions)
+	}
+
+	texts, partMentions := splitMessageText(info.Text, mentions)
+	parts := make([]*groupme.Message, len(texts))
+	for i, text := range texts {
+		part := info
+		part.Text = text
+		part.Attachments = nil
+		if i == 0 {
+			part.Attachments = append(part.Attachments, info.Attachments...)
+		}
+		if partMentions[i] != nil {
+			part.Attachments = append(part.Attachments, partMentions[i])
+		}
+		if emojiCount := strings.Count(text, groupMeEmojiPlaceholder); emojiCount > 0 && emojiCount <= len(emojiCharmap) {
+			part.Attachments = append(part.Attachments, &groupme.Attachment{
+				Type:        groupme.Emoji,
+				Placeholder: groupMeEmojiPlaceholder,
+				Charmap:     emojiCharmap[:emojiCount],
+			})
+			emojiCharmap = emojiCharmap[emojiCount:]
+		}
+		part.SourceGUID = sourceGUIDFor(evt.ID, i)
+		parts[i] = &part
+	}
+	return parts, sender, nil
+}
+
+var sourceGUIDNamespace = uuid.MustParse("2e04acf1-7a8d-40d8-89d5-d71dfb023a0e")
+
+// sourceGUIDFor returns the GroupMe source_guid for a part of a Matrix event.
+// It's deterministic, so that sending the same event again produces the same
+// source_guid and the echo can always be matched to the event.
+func sourceGUIDFor(evtID id.EventID, part int) string {
+	return uuid.NewSHA1(sourceGUIDNamespace, []byte(fmt.Sprintf("%s/%d", evtID, part))).String()
+}
+
+// addRelaybotFormat replaces the content of a message sent through the relay
+// user with the configured relay template, so that GroupMe users can tell who
+// actually sent it.
+func (portal *Portal) addRelaybotFormat(userID id.UserID, content *event.MessageEventContent) bool {
+	member := portal.MainIntent().Member(portal.MXID, userID)
+	if member == nil {
+		member = &event.MemberEventContent{}
+	}
+
+	if content.Format != event.FormatHTML {
+		content.FormattedBody = strings.ReplaceAll(html.EscapeString(content.Body), "\n", "<br/>")
+		content.Format = event.FormatHTML
+	}
+	data, err := portal.bridge.Config.Bridge.Relay.FormatMessage(content, userID, *member)
+	if err != nil {
+		portal.log.Errorln("Failed to apply relaybot format:", err)
+		return false
+	}
+	content.FormattedBody = data
+	return true
+}
+
+// getReplyQuote builds a quote of a Matrix event that isn't bridged to GroupMe,
+// so that replies to it still have some context on the GroupMe side.
+func (portal *Portal) getReplyQuote(evtID id.EventID) string {
+	evt, err := portal.MainIntent().GetEvent(portal.MXID, evtID)
+	if err != nil {
+		portal.log.Warnfln("Failed to get reply target %s: %v", evtID, err)
+		return ""
+	}
+	if evt.Type == event.EventEncrypted {
+		if portal.bridge.Crypto == nil {
+			return ""
+		}
+		err = evt.Content.ParseRaw(evt.Type)
+		if err == nil {
+			evt, err = portal.bridge.Crypto.Decrypt(evt)
+		}
+		if err != nil {
+			portal.log.Warnfln("Failed to decrypt reply target %s: %v", evtID, err)
+			return ""
+		}
+	} else {
+		_ = evt.Content.ParseRaw(evt.Type)
+	}
+	content, ok := evt.Content.Parsed.(*event.MessageEventContent)
+	if !ok || len(content.Body) == 0 {
+		return ""
+	}
+	content.RemoveReplyFallback()
+
+	var quote strings.Builder
+	for _, line := range strings.Split(strings.TrimSpace(content.Body), "\n") {
+		quote.WriteString("> ")
+		quote.WriteString(line)
+		quote.WriteByte('\n')
+	}
+	return quote.String()
+}
+
+func (portal *Portal) uploadMatrixMedia(sender *User, conversationID groupme.ID, content *event.MessageEventContent) (*groupme.Attachment, error) {
+	var mxc id.ContentURI
+	var err error
+	if content.File != nil {
+		mxc, err = content.File.URL.Parse()
+	} else {
+		mxc, err = content.URL.Parse()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errMediaDownloadFailed, err)
+	}
+
+	data, err := portal.MainIntent().DownloadBytes(mxc)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errMediaDownloadFailed, err)
+	}
+	if content.File != nil {
+		err = content.File.DecryptInPlace(data)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", errMediaDecryptFailed, err)
 		}
-		info.Text = text
+	}
 
+	fileName := content.Body
+	if content.FileName != "" {
+		fileName = content.FileName
+	}
+	mime := content.GetInfo().MimeType
+	if mime == "" {
+		mime = mimetype.Detect(data).String()
+	}
+
+	switch content.MsgType {
+	// GIFs are left as images: the GroupMe image service accepts them and
+	// clients play them, while the video service would transcode them.
+	case event.MsgImage:
+		imageURL, err := groupmeext.UploadImage(data, mime, sender.Token, portal.log)
+		if err != nil {
+			return nil, wrapMediaUploadError(err)
+		}
+		return &groupme.Attachment{
+			Type: groupme.Image,
+			URL:  imageURL,
+		}, nil
+	case event.MsgVideo:
+		videoURL, previewURL, err := groupmeext.UploadVideo(conversationID, fileName, data, sender.Token, portal.log)
+		if err != nil {
+			return nil, wrapMediaUploadError(err)
+		}
+		return &groupme.Attachment{
+			Type:            groupmeext.VideoAttachment,
+			URL:             videoURL,
+			VideoPreviewURL: previewURL,
+		}, nil
 	default:
-		portal.log.Debugln("Unhandled Matrix event %s: unknown msgtype %s", evt.ID, content.MsgType)
-		return nil, sender
+		fileID, err := groupmeext.UploadFile(conversationID, fileName, data, sender.Token, portal.log)
+		if err != nil {
+			return nil, wrapMediaUploadError(err)
+		}
+		return &groupme.Attachment{
+			Type:   groupmeext.FileAttachment,
+			FileID: fileID,
+		}, nil
 	}
-	return []*groupme.Message{&info}, sender
 }
 
 func (portal *Portal) wasMessageSent(sender *User, id string) bool {
@@ -1378,54 +1890,194 @@ func (portal *Portal) wasMessageSent(sender *User, id string) bool {
 var timeout = errors.New("message sending timed out")
 
 func (portal *Portal) HandleMatrixMessage(sender *User, evt *event.Event) {
-	portal.log.Debugfln("Received event %s", evt.ID)
-	info, sender := portal.convertMatrixMessage(sender, evt)
-	if info == nil {
-		return
+	err := portal.queueMatrixMessage(sender, evt)
+	if err != nil {
+		portal.sendMessageMetrics(evt, err, "Error sending", nil)
 	}
-	for _, i := range info {
-		portal.log.Debugln("Sending event", evt.ID, "to GroupMe", info[0].ID)
+}
 
-		var err error
-		i, err = portal.sendRaw(sender, evt, info[0], -1) //TODO deal with multiple messages for longer messages
+func (portal *Portal) handleMatrixMessage(ctx context.Context, sender *User, evt *event.Event) error {
+	portal.log.Debugfln("Received event %s", evt.ID)
+	if evt.Type == EventPollStart {
+		return portal.handleMatrixPollStart(ctx, sender, evt)
+	}
+	parts, sender, err := portal.convertMatrixMessage(sender, evt)
+	if err != nil {
+		return err
+	}
+	existingParts := make(map[int]*database.Message)
+	for _, msg := range portal.bridge.DB.Message.GetAllByMXID(evt.ID) {
+		existingParts[msg.Part] = msg
+	}
+	for part, info := range parts {
+		dbMsg := existingParts[part]
+		if dbMsg != nil && dbMsg.Sent {
+			portal.log.Debugfln("Not sending part %d of event %s: it was already sent as %s", part, evt.ID, dbMsg.GMID)
+			continue
+		} else if dbMsg == nil {
+			dbMsg = portal.markPending(sender, info, evt.ID, part)
+		}
+		portal.log.Debugfln("Sending part %d of event %s to GroupMe", part, evt.ID)
+		msg, err := portal.sendRaw(ctx, sender, info)
 		if err != nil {
-			portal.log.Warnln("Unable to handle message from Matrix", evt.ID)
-			//TODO handle deleted room and such
-		} else {
-			portal.markHandled(sender, i, evt.ID)
+			// If the request failed with a network error or timed out, the
+			// message may still have reached GroupMe. The pending row is
+			// kept so that the echo is recognized and the next attempt
+			// reuses the same source GUID.
+			if !isAmbiguousSendError(err) {
+				dbMsg.Delete()
+			}
+			return err
 		}
+		dbMsg.MarkSent(msg.ID, msg.CreatedAt.ToTime())
+		portal.addRecentlyHandled(msg.ID)
 	}
+	return nil
 }
 
-func (portal *Portal) sendRaw(sender *User, evt *event.Event, info *groupme.Message, retries int) (*groupme.Message, error) {
-	if retries == -1 {
-		retries = 2
+const (
+	sendMaxRetries    = 3
+	sendRetryBaseWait = 2 * time.Second
+)
+
+// sendRaw sends a message to GroupMe. Requests that fail because of rate
+// limits or network errors are retried with exponential backoff, other
+// errors are returned immediately.
+func (portal *Portal) sendRaw(ctx context.Context, sender *User, info *groupme.Message) (*groupme.Message, error) {
+	wait := sendRetryBaseWait
+	for retry := 0; ; retry++ {
+		msg, err := sender.Client.SendMessage(ctx, info, portal.IsPrivateChat())
+		err = wrapGroupMeError(err)
+		if err == nil {
+			return msg, nil
+		} else if retry >= sendMaxRetries || !isRetriableError(err) {
+			return nil, err
+		}
+		portal.log.Warnfln("Failed to send message to %s (retrying in %s): %v", portal.Key, wait, err)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		wait *= 2
 	}
+}
 
-	var m *groupme.Message
-	var err error
+// groupMeLikeEmoji is the reaction that plain GroupMe likes are bridged as.
+const groupMeLikeEmoji = "\u2764"
 
-	if portal.IsPrivateChat() {
-		m, err = sender.Client.CreateDirectMessage(context.TODO(), info)
-	} else {
-		m, err = sender.Client.CreateMessage(context.TODO(), info.GroupID, info)
-	}
+// groupMeLikeEmojis are the reactions that are sent to GroupMe as plain likes.
+var groupMeLikeEmojis = map[string]bool{
+	"\u2764":     true,
+	"\U0001f44d": true,
+}
 
-	id := ""
-	if m != nil {
-		id = m.ID.String()
+func (portal *Portal) handleMatrixReaction(ctx context.Context, sender *User, evt *event.Event) error {
+	if !sender.IsLoggedIn() {
+		return errUserNotLoggedIn
+	}
+	content, ok := evt.Content.Parsed.(*event.ReactionEventContent)
+	if !ok {
+		return fmt.Errorf("unexpected parsed content type %T", evt.Content.Parsed)
+	}
+	var targets []*database.Message
+	for _, target := range portal.bridge.DB.Message.GetAllByMXID(content.RelatesTo.EventID) {
+		if target.Sent {
+			targets = append(targets, target)
+		}
+	}
+	if len(targets) == 0 {
+		return fmt.Errorf("%w %s", errReactionTargetNotFound, content.RelatesTo.EventID)
 	}
-	if err != nil {
-		portal.log.Warnln(err, id, info.GroupID.String())
 
-		if retries > 0 {
-			return portal.sendRaw(sender, evt, info, retries-1)
+	key := variationselector.Remove(content.RelatesTo.Key)
+	conversationID := groupme.ID(portal.Key.String())
+	isLike := portal.isLikeReactionKey(key)
+	replaced := make(map[id.EventID]bool)
+	for _, target := range targets {
+		var err error
+		if isLike {
+			err = sender.Client.CreateLike(ctx, conversationID, target.GMID)
+		} else {
+			err = sender.Client.ReactToMessage(ctx, conversationID, target.GMID, variationselector.FullyQualify(key))
+		}
+		if err != nil {
+			return wrapGroupMeError(err)
 		}
+
+		// GroupMe only has one like per user, so the new reaction replaces any previous one.
+		existing := portal.bridge.DB.Reaction.GetByTargetGMID(portal.Key, target.GMID, sender.GMID)
+		if existing != nil && existing.MXID != evt.ID && !replaced[existing.MXID] {
+			replaced[existing.MXID] = true
+			_, err = portal.MainIntent().RedactEvent(portal.MXID, existing.MXID)
+			if err != nil {
+				portal.log.Warnfln("Failed to redact replaced reaction %s: %v", existing.MXID, err)
+			}
+		}
+		dbReaction := portal.bridge.DB.Reaction.New()
+		dbReaction.Chat = portal.Key
+		dbReaction.TargetGMID = target.GMID
+		dbReaction.TargetPart = target.Part
+		dbReaction.Sender = sender.GMID
+		dbReaction.MXID = evt.ID
+		dbReaction.Emoji = key
+		dbReaction.Upsert(nil)
 	}
-	return m, nil
+	return nil
 }
 
+// HandleMatrixRedaction queues a redaction in the outbox. Redacting an event
+// that is still waiting in the outbox drops it, so that it's never sent.
 func (portal *Portal) HandleMatrixRedaction(sender *User, evt *event.Event) {
+	if portal.dropQueuedEvent(evt.Redacts) && len(portal.bridge.DB.Message.GetAllByMXID(evt.Redacts)) == 0 {
+		portal.sendMessageMetrics(evt, nil, "Error sending", nil)
+		return
+	}
+	portal.HandleMatrixMessage(sender, evt)
+}
+
+func (portal *Portal) handleMatrixRedaction(ctx context.Context, sender *User, evt *event.Event) error {
+	if !sender.IsLoggedIn() {
+		return errUserNotLoggedIn
+	}
+	if reactions := portal.bridge.DB.Reaction.GetAllByMXID(evt.Redacts); len(reactions) > 0 {
+		for _, reaction := range reactions {
+			err := portal.handleMatrixReactionRedaction(ctx, sender, reaction)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	parts := portal.bridge.DB.Message.GetAllByMXID(evt.Redacts)
+	if len(parts) == 0 {
+		return fmt.Errorf("%w %s", errTargetNotFound, evt.Redacts)
+	}
+	for _, msg := range parts {
+		if !msg.Sent {
+			// Parts that failed to send only exist in the database.
+			msg.Delete()
+			continue
+		}
+		err := sender.Client.DeleteMessage(ctx, groupme.ID(portal.Key.String()), msg.GMID)
+		if err != nil {
+			return fmt.Errorf("failed to delete message: %w", wrapGroupMeError(err))
+		}
+		msg.Delete()
+	}
+	return nil
+}
+
+func (portal *Portal) handleMatrixReactionRedaction(ctx context.Context, sender *User, reaction *database.Reaction) error {
+	if reaction.Sender != sender.GMID {
+		return errReactionSentBySomeoneElse
+	}
+	err := sender.Client.DestroyLike(ctx, groupme.ID(portal.Key.String()), reaction.TargetGMID)
+	if err != nil {
+		return wrapGroupMeError(err)
+	}
+	reaction.Delete()
+	return nil
 }
 
 func (portal *Portal) Delete() {
@@ -1507,7 +2159,8 @@ func (portal *Portal) Cleanup(puppetsOnly bool) {
 	}
 }
 
-func (portal *Portal) HandleMatrixLeave(sender *User) {
+func (portal *Portal) HandleMatrixLeave(brSender bridge.User) {
+	sender := brSender.(*User)
 	if portal.IsPrivateChat() {
 		portal.log.Debugln("User left private chat portal, cleaning up and deleting...")
 		portal.Delete()
@@ -1524,8 +2177,158 @@ func (portal *Portal) HandleMatrixLeave(sender *User) {
 	}
 }
 
-func (portal *Portal) HandleMatrixKick(sender *User, evt *event.Event) {
+func (portal *Portal) HandleMatrixMeta(brSender bridge.User, evt *event.Event) {
+	portal.matrixMessages <- PortalMatrixMessage{user: brSender.(*User), evt: evt, receivedAt: time.Now()}
+}
+
+func (portal *Portal) handleMatrixMeta(ctx context.Context, sender *User, evt *event.Event) {
+	if portal.IsPrivateChat() {
+		return
+	}
+
+	var update groupmeext.GroupUpdate
+	var revert func()
+	var avatarURL string
+	switch content := evt.Content.Parsed.(type) {
+	case *event.RoomNameEventContent:
+		if content.Name == portal.Name {
+			return
+		}
+		update.Name = &content.Name
+		oldName := portal.Name
+		revert = func() { _, _ = portal.MainIntent().SetRoomName(portal.MXID, oldName) }
+	case *event.TopicEventContent:
+		if content.Topic == portal.Topic {
+			return
+		}
+		update.Description = &content.Topic
+		oldTopic := portal.Topic
+		revert = func() { _, _ = portal.MainIntent().SetRoomTopic(portal.MXID, oldTopic) }
+	case *event.RoomAvatarEventContent:
+		if content.URL == portal.AvatarURL {
+			return
+		}
+		update.ImageURL = &avatarURL
+		oldAvatar := portal.AvatarURL
+		revert = func() { _, _ = portal.MainIntent().SetRoomAvatar(portal.MXID, oldAvatar) }
+	default:
+		return
+	}
+
+	// The relay user isn't used for group info changes, as GroupMe would show
+	// them as made by the relay user.
+	if !sender.IsLoggedIn() {
+		portal.log.Debugfln("Not bridging group info change %s: %s isn't logged in", evt.ID, sender.MXID)
+		revert()
+		portal.sendMetaChangeNotice("\u26a0 Your change wasn't bridged to GroupMe, because you're not logged in")
+		return
+	}
+	if content, ok := evt.Content.Parsed.(*event.RoomAvatarEventContent); ok && !content.URL.IsEmpty() {
+		data, err := portal.MainIntent().DownloadBytes(content.URL)
+		if err != nil {
+			portal.log.Errorfln("Failed to download new room avatar %s: %v", content.URL, err)
+			portal.sendMetaChangeNotice("\u26a0 Failed to bridge the new room avatar to GroupMe")
+			return
+		}
+		avatarURL, err = groupmeext.UploadImage(data, mimetype.Detect(data).String(), sender.Token, portal.log)
+		if err != nil {
+			portal.log.Errorfln("Failed to upload new room avatar to GroupMe: %v", err)
+			portal.sendMetaChangeNotice("\u26a0 Failed to bridge the new room avatar to GroupMe")
+			return
+		}
+	}
+
+	_, err := sender.Client.UpdateGroupInfo(ctx, portal.Key.GMID, update)
+	var meta *groupme.Meta
+	if errors.As(err, &meta) && (meta.Code == http.StatusUnauthorized || meta.Code == http.StatusForbidden) {
+		portal.log.Debugfln("%s isn't allowed to change the info of %s: %v", sender.MXID, portal.Key, err)
+		revert()
+		portal.sendMetaChangeNotice("\u26a0 You don't have permission to change the group info on GroupMe")
+		return
+	} else if err != nil {
+		portal.log.Errorfln("Failed to update group info of %s: %v", portal.Key, err)
+		portal.sendMetaChangeNotice("\u26a0 Failed to bridge your change of the group info to GroupMe")
+		return
+	}
+
+	switch content := evt.Content.Parsed.(type) {
+	case *event.RoomNameEventContent:
+		portal.Name = content.Name
+		portal.NameSet = true
+	case *event.TopicEventContent:
+		portal.Topic = content.Topic
+		portal.TopicSet = true
+	case *event.RoomAvatarEventContent:
+		portal.Avatar = avatarURL
+		portal.AvatarURL = content.URL
+		portal.AvatarSet = true
+	}
+	portal.Update(nil)
+	portal.UpdateBridgeInfo()
+}
+
+func (portal *Portal) sendMetaChangeNotice(message string) {
+	_, err := portal.sendMainIntentMessage(&event.MessageEventContent{
+		MsgType: event.MsgNotice,
+		Body:    message,
+	})
+	if err != nil {
+		portal.log.Warnln("Failed to send group info change notice:", err)
+	}
 }
 
-func (portal *Portal) HandleMatrixInvite(sender *User, evt *event.Event) {
+func (portal *Portal) HandleMatrixKick(brSender bridge.User, brGhost bridge.Ghost) {
+	sender := brSender.(*User)
+	puppet := brGhost.(*Puppet)
+	if portal.IsPrivateChat() {
+		return
+	}
+	err := sender.Client.RemoveFromGroup(puppet.GMID, portal.Key.GMID)
+	if err != nil {
+		portal.log.Errorfln("Failed to remove %s from group as %s: %v", puppet.GMID, sender.MXID, err)
+		_, _ = portal.sendMainIntentMessage(&event.MessageEventContent{
+			MsgType: event.MsgNotice,
+			Body:    fmt.Sprintf("\u26a0 Failed to remove %s from the GroupMe group: %v", puppet.Displayname, err),
+		})
+		return
+	}
+	portal.log.Debugfln("Removed %s from group as %s", puppet.GMID, sender.MXID)
+}
+
+func (portal *Portal) HandleMatrixInvite(brSender bridge.User, brGhost bridge.Ghost) {
+	puppet := brGhost.(*Puppet)
+	portal.addToGroup(brSender.(*User), puppet.GMID, puppet.Displayname)
+}
+
+// addToGroupTimeout is how long adding a member may take, including waiting
+// for GroupMe to process the request.
+const addToGroupTimeout = 30 * time.Second
+
+// addToGroup adds a GroupMe user to the group after they were invited on
+// Matrix. The puppet joins the room on the next SyncParticipants once GroupMe
+// reports the new membership. GroupMe adds members asynchronously, so this is
+// done in the background and the result is reported to the room.
+func (portal *Portal) addToGroup(sender *User, gmid groupme.ID, nickname string) {
+	if portal.IsPrivateChat() {
+		return
+	}
+	go portal.doAddToGroup(sender, gmid, nickname)
+}
+
+func (portal *Portal) doAddToGroup(sender *User, gmid groupme.ID, nickname string) {
+	ctx, cancel := context.WithTimeout(context.Background(), addToGroupTimeout)
+	defer cancel()
+	var msg string
+	err := sender.Client.AddToGroup(ctx, gmid, portal.Key.GMID, nickname)
+	if err != nil {
+		portal.log.Errorfln("Failed to add %s to group as %s: %v", gmid, sender.MXID, err)
+		msg = fmt.Sprintf("\u26a0 Failed to add %s to the GroupMe group: %v", nickname, err)
+	} else {
+		portal.log.Debugfln("Added %s to group as %s", gmid, sender.MXID)
+		msg = fmt.Sprintf("Added %s to the GroupMe group", nickname)
+	}
+	_, _ = portal.sendMainIntentMessage(&event.MessageEventContent{
+		MsgType: event.MsgNotice,
+		Body:    msg,
+	})
 }
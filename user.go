@@ -348,11 +348,22 @@ func (user *User) Connect() bool {
 	user.log.Debugln("Starting listening on PushSubscription")
 	user.Conn.StartListening(context.Background(), groupmeext.NewFayeClient(user.log))
 	user.Conn.AddFullHandler(user)
+	groupmeext.AddPushHandler(user.Conn, user)
 
 	//TODO: typing notification?
 	return user.RestoreSession()
 }
 
+// DeleteConnection forgets the GroupMe push connection of the user and
+// unregisters its push handler, so that a later Connect starts a new one.
+func (user *User) DeleteConnection() {
+	if user.Conn == nil {
+		return
+	}
+	groupmeext.RemovePushHandler(user.Conn)
+	user.Conn = nil
+}
+
 func (user *User) RestoreSession() bool {
 	if len(user.Token) > 0 {
 		err := user.Conn.SubscribeToUser(context.TODO(), groupme.ID(user.GMID), user.Token)
@@ -381,7 +392,7 @@ func (user *User) IsConnected() bool {
 }
 
 func (user *User) IsLoggedIn() bool {
-	return true
+	return user.Client != nil
 }
 
 func (user *User) IsLoginInProgress() bool {
@@ -813,14 +824,17 @@ func (user *User) handleMessageLoop() {
 		select {
 		case msg := <-user.messageOutput:
 			user.bridge.Metrics.TrackBufferLength(user.MXID, len(user.messageOutput))
-			puppet := user.bridge.GetPuppetByGMID(msg.data.UserID)
 			portal := user.bridge.GetPortalByGMID(msg.chat)
-			if puppet != nil {
-				puppet.Sync(user, &groupme.Member{
-					UserID:   msg.data.UserID,
-					Nickname: msg.data.Name,
-					ImageURL: msg.data.AvatarURL,
-				}, false, false)
+			// Deletions and poll updates don't have a sender to sync.
+			if len(msg.data.UserID) > 0 {
+				puppet := user.bridge.GetPuppetByGMID(msg.data.UserID)
+				if puppet != nil {
+					puppet.Sync(user, &groupme.Member{
+						UserID:   msg.data.UserID,
+						Nickname: msg.data.Name,
+						ImageURL: msg.data.AvatarURL,
+					}, false, false)
+				}
 			}
 			portal.messages <- msg
 		}
@@ -828,6 +842,10 @@ func (user *User) handleMessageLoop() {
 }
 
 func (user *User) HandleTextMessage(message groupme.Message) {
+	user.queueMessage(message, false)
+}
+
+func (user *User) queueMessage(message groupme.Message, isLike bool) {
 	id := database.ParsePortalKey(message.GroupID.String())
 
 	if id == nil {
@@ -838,11 +856,59 @@ func (user *User) HandleTextMessage(message groupme.Message) {
 		return
 	}
 
-	user.messageInput <- PortalMessage{*id, user, &message, uint64(message.CreatedAt.ToTime().Unix())}
+	user.messageInput <- PortalMessage{chat: *id, source: user, data: &message, timestamp: uint64(message.CreatedAt.ToTime().Unix()), isLike: isLike}
 }
 
 func (user *User) HandleLike(msg groupme.Message) {
-	user.HandleTextMessage(msg)
+	user.queueMessage(msg, true)
+}
+
+func (user *User) HandleMessageDeleted(chat, messageID groupme.ID) {
+	key := database.ParsePortalKey(chat.String())
+	if key == nil {
+		user.log.Warnfln("Error parsing portal key %s of deleted message %s", chat, messageID)
+		return
+	}
+	portal := user.bridge.GetPortalByGMID(*key)
+	if len(portal.MXID) == 0 {
+		return
+	}
+	// The deletion goes through the same buffer as messages, so that it can't
+	// overtake the message it deletes.
+	user.messageInput <- PortalMessage{
+		chat:       *key,
+		source:     user,
+		data:       &groupme.Message{ID: messageID},
+		isDeletion: true,
+	}
+}
+
+func (user *User) HandlePollUpdate(chat, pollID groupme.ID) {
+	key := database.ParsePortalKey(chat.String())
+	if key == nil {
+		user.log.Warnfln("Error parsing portal key %s of poll %s", chat, pollID)
+		return
+	}
+	portal := user.bridge.GetPortalByGMID(*key)
+	if len(portal.MXID) == 0 {
+		return
+	}
+	// Like deletions, poll updates must not overtake the message of the poll.
+	user.messageInput <- PortalMessage{
+		chat:   *key,
+		source: user,
+		data:   &groupme.Message{},
+		pollID: pollID,
+	}
+}
+
+func (user *User) HandleCalendarEvent(chat groupme.ID, eventID string) {
+	key := database.ParsePortalKey(chat.String())
+	if key == nil {
+		user.log.Warnfln("Error parsing portal key %s of calendar event %s", chat, eventID)
+		return
+	}
+	user.bridge.GetPortalByGMID(*key).queueCalendarEventResync(user, eventID)
 }
 
 func (user *User) HandleJoin(id groupme.ID) {
@@ -873,8 +939,11 @@ func (user *User) HandleGroupAvatar(_ groupme.ID, _ string) {
 	user.HandleChatList()
 }
 
-func (user *User) HandleLikeIcon(_ groupme.ID, _, _ int, _ string) {
-	//TODO
+func (user *User) HandleLikeIcon(groupID groupme.ID, packID, packIndex int, iconType string) {
+	portal := user.bridge.GetPortalByGMID(database.GroupPortalKey(groupID))
+	if portal != nil {
+		portal.UpdateLikeIcon(iconType, packID, packIndex)
+	}
 }
 
 func (user *User) HandleNewNickname(groupID, userID groupme.ID, name string) {
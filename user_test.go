@@ -1,6 +1,11 @@
 package main
 
 import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -9,65 +14,70 @@ import (
 	"github.com/beeper/groupme/database"
 	_ "github.com/mattn/go-sqlite3"
 	"maunium.net/go/maulogger/v2"
+	"maunium.net/go/mautrix/appservice"
+	"maunium.net/go/mautrix/bridge/bridgeconfig"
 	"maunium.net/go/mautrix/id"
 	"maunium.net/go/mautrix/util/dbutil"
 )
 
+// newTestHomeserver starts a fake homeserver that accepts every request.
+// Created rooms get sequential IDs.
+func newTestHomeserver(t *testing.T) *httptest.Server {
+	var roomCount int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/createRoom"):
+			_, _ = fmt.Fprintf(w, `{"room_id": "!room%d:example.com"}`, atomic.AddInt32(&roomCount, 1))
+		case r.Method == http.MethodPut && strings.Contains(r.URL.Path, "/state/"):
+			_, _ = w.Write([]byte(`{"event_id": "$state"}`))
+		default:
+			_, _ = w.Write([]byte(`{}`))
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
 func newTestUser(t *testing.T) (*GMBridge, *User) {
-	db, err := dbutil.NewFromConfig("sqlite3", ":memory:", dbutil.MauLogger(maulogger.Create()))
+	db, err := dbutil.NewFromConfig("", dbutil.Config{Type: "sqlite3", URI: ":memory:", MaxOpenConns: 1, MaxIdleConns: 1}, dbutil.MauLogger(maulogger.Create()))
 	if err != nil {
 		t.Fatalf("Failed to create db: %v", err)
 	}
 
-	// Create tables
-	_, err = db.Exec(`
-    CREATE TABLE user (
-        gmid TEXT PRIMARY KEY,
-        mxid TEXT,
-        auth_token TEXT,
-        management_room TEXT,
-        space_room TEXT
-    );
-    CREATE TABLE portal (
-        gmid TEXT,
-        receiver TEXT,
-        mxid TEXT,
-        name TEXT,
-        name_set BOOLEAN,
-        topic TEXT,
-        topic_set BOOLEAN,
-        avatar TEXT,
-        avatar_url TEXT,
-        avatar_set BOOLEAN,
-        encrypted BOOLEAN,
-        PRIMARY KEY (gmid, receiver)
-    );
-    CREATE TABLE user_portal (
-        user_mxid TEXT,
-        portal_gmid TEXT,
-        portal_receiver TEXT,
-        in_space BOOLEAN,
-        PRIMARY KEY (user_mxid, portal_gmid, portal_receiver)
-    );
-    `)
-	if err != nil {
+	br := &GMBridge{
+		Config: &config.Config{BaseConfig: &bridgeconfig.BaseConfig{}},
+	}
+	br.Log = maulogger.Create()
+	br.DB = database.New(db, br.Log)
+	// Create the tables from the real upgrades, so that the schema matches
+	// what the bridge actually uses.
+	if err = br.DB.Upgrade(); err != nil {
 		t.Fatalf("Failed to create tables: %v", err)
 	}
+	br.Config.Homeserver.Domain = "example.com"
+	br.Config.Bridge.PersonalFilteringSpaces = true
 
-	br := &GMBridge{
-		DB:     database.New(db.Database),
-		Config: &config.Config{},
-		Log:    maulogger.Create(),
+	br.AS = appservice.Create()
+	br.AS.HomeserverDomain = "example.com"
+	br.AS.Registration = &appservice.Registration{AppToken: "as_token", SenderLocalpart: "groupmebot"}
+	if err = br.AS.SetHomeserverURL(newTestHomeserver(t).URL); err != nil {
+		t.Fatalf("Failed to set homeserver URL: %v", err)
 	}
-	br.Config.Bridge.PersonalFilteringSpaces = true
+	br.Bot = br.AS.BotIntent()
 
 	user := br.NewUser(br.DB.User.New())
 	user.MXID = id.NewUserID("testuser", "example.com")
 	user.GMID = "123456"
-	user.inSpaceCache = make(map[database.PortalKey]bool)
 	return br, user
 }
 
+// staleChatTime returns a last activity time that is too old for syncPortals
+// to sync the portals themselves, which would need a GroupMe connection.
+func staleChatTime() time.Time {
+	return time.Now().Add(-SyncMaxChatAge - time.Hour)
+}
+
 func TestSyncPortals_NewGroup(t *testing.T) {
 	br, user := newTestUser(t)
 
@@ -77,7 +87,7 @@ func TestSyncPortals_NewGroup(t *testing.T) {
 		groupme.ID(groupID): {
 			ID:        groupme.ID(groupID),
 			Name:      "Test Group",
-			UpdatedAt: groupme.Time{Time: time.Now()},
+			UpdatedAt: groupme.FromTime(staleChatTime()),
 		},
 	}
 
@@ -93,10 +103,16 @@ func TestSyncPortals_NewGroup(t *testing.T) {
 	br.portalsByGMID = make(map[database.PortalKey]*Portal)
 	br.portalsByMXID = make(map[id.RoomID]*Portal)
 
+	// Only portals with a room can be added to the space, so the room is
+	// created before the sync, as if the portal had just been bridged.
+	portalKey := database.GroupPortalKey(groupme.ID(groupID))
+	portal := br.GetPortalByGMID(portalKey)
+	portal.MXID = "!new:example.com"
+	portal.Update(nil)
+
 	user.syncPortals(false)
 
 	// Check if portal was added to user_portal table (marked in space)
-	portalKey := database.GroupPortalKey(groupme.ID(groupID))
 	if !user.IsInSpace(portalKey) {
 		t.Errorf("Expected portal %s to be in space", groupID)
 	}
@@ -113,13 +129,14 @@ func TestSyncPortals_ExistingGroup(t *testing.T) {
 	// Pre-create portal in DB
 	dbPortal := br.DB.Portal.New()
 	dbPortal.Key = portalKey
+	dbPortal.MXID = "!existing:example.com"
 	dbPortal.Insert()
 
 	user.GroupList = map[groupme.ID]groupme.Group{
 		groupme.ID(groupID): {
 			ID:        groupme.ID(groupID),
 			Name:      "Existing Group",
-			UpdatedAt: groupme.Time{Time: time.Now()},
+			UpdatedAt: groupme.FromTime(staleChatTime()),
 		},
 	}
 